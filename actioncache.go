@@ -0,0 +1,384 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// actionCache is a local content-addressed cache of outputs of
+// recipes in the following layout:
+//
+//	<dir>/ac/<key>     the digest and the permission of the output of
+//	                   the action <key>
+//	<dir>/cas/<digest> the contents of the output
+//
+// Files are touched when used, and the least recently used files are
+// removed when the total size exceeds maxSize.
+type actionCache struct {
+	dir     string
+	maxSize int64
+
+	mu sync.Mutex
+	// size is the estimated total size of the files. It is counted
+	// up by put, and recomputed by evict, as other processes may
+	// share the cache.
+	size int64
+}
+
+func newActionCache(dir string, maxSize int64) (*actionCache, error) {
+	for _, sub := range []string{"ac", "cas"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &actionCache{
+		dir:     dir,
+		maxSize: maxSize,
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		c.size += e.size
+	}
+	return c, nil
+}
+
+// outputCache stores outputs of actions by their keys.
+type outputCache interface {
+	// get restores output of the action key, and reports whether
+	// it was found.
+	get(key, output string) (bool, error)
+	// put stores output as the result of the action key.
+	put(key, output string) error
+}
+
+// casDigest returns the SHA-256 digest of the contents of filename in
+// hex, and its permission.
+func casDigest(filename string) (string, os.FileMode, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), fi.Mode().Perm(), nil
+}
+
+// actionEntry is the contents of an action entry, i.e. the digest and
+// the permission of the output.
+func actionEntry(digest string, mode os.FileMode) []byte {
+	return []byte(fmt.Sprintf("%s %o\n", digest, mode))
+}
+
+func parseActionEntry(b []byte) (string, os.FileMode, error) {
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("broken action entry: %q", b)
+	}
+	mode, err := strconv.ParseUint(fields[1], 8, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("broken action entry: %q", b)
+	}
+	return fields[0], os.FileMode(mode), nil
+}
+
+// actionKey returns the key of the action which builds n by rr with
+// env, the exported variables. Other environment variables are not in
+// the key, so it is shared among shells and machines. It returns an
+// error if an input of n can't be read.
+func actionKey(n *DepNode, rr []runner, env []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "output %q\n", n.Output)
+	for _, r := range rr {
+		fmt.Fprintf(h, "cmd %q %q %t\n", r.shell, r.cmd, r.ignoreError)
+	}
+	env = append([]string(nil), env...)
+	sort.Strings(env)
+	for _, e := range env {
+		fmt.Fprintf(h, "env %q\n", e)
+	}
+	for _, input := range n.ActualInputs {
+		d, err := digestFile(input)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "input %q %x\n", input, d)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *actionCache) acPath(key string) string {
+	return filepath.Join(c.dir, "ac", key)
+}
+
+func (c *actionCache) casPath(digest string) string {
+	return filepath.Join(c.dir, "cas", digest)
+}
+
+// touch marks filename as recently used.
+func touch(filename string) {
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+}
+
+// get restores output from the cache. It reports whether the action
+// key was found.
+func (c *actionCache) get(key, output string) (bool, error) {
+	b, err := ioutil.ReadFile(c.acPath(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	digest, _, err := parseActionEntry(b)
+	if err != nil {
+		return false, err
+	}
+	src := c.casPath(digest)
+	err = copyFile(src, output)
+	if os.IsNotExist(err) {
+		// Evicted while the action entry is alive.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	touch(c.acPath(key))
+	touch(src)
+	return true, nil
+}
+
+// put stores output as the result of the action key.
+func (c *actionCache) put(key, output string) error {
+	digest, mode, err := casDigest(output)
+	if err != nil {
+		return err
+	}
+	var added int64
+	dst := c.casPath(digest)
+	if _, err := os.Stat(dst); err == nil {
+		touch(dst)
+	} else {
+		err = copyFile(output, dst)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(dst); err == nil {
+			added += fi.Size()
+		}
+	}
+	entry := actionEntry(digest, mode)
+	err = writeFileAtomic(c.acPath(key), entry, 0644)
+	if err != nil {
+		return err
+	}
+	added += int64(len(entry))
+	c.mu.Lock()
+	c.size += added
+	full := c.maxSize > 0 && c.size > c.maxSize
+	c.mu.Unlock()
+	if !full {
+		return nil
+	}
+	return c.evict()
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+type cacheEntriesByTime []cacheEntry
+
+func (e cacheEntriesByTime) Len() int           { return len(e) }
+func (e cacheEntriesByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e cacheEntriesByTime) Less(i, j int) bool { return e[i].modTime.Before(e[j].modTime) }
+
+// entries returns the files in the cache.
+func (c *actionCache) entries() ([]cacheEntry, error) {
+	var entries []cacheEntry
+	for _, sub := range []string{"ac", "cas"} {
+		fis, err := ioutil.ReadDir(filepath.Join(c.dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				continue
+			}
+			entries = append(entries, cacheEntry{
+				path:    filepath.Join(c.dir, sub, fi.Name()),
+				size:    fi.Size(),
+				modTime: fi.ModTime(),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// evict removes the least recently used entries until the cache fits
+// in 90% of maxSize, so that it is not run again soon.
+func (c *actionCache) evict() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	c.size = total
+	if total <= c.maxSize {
+		return nil
+	}
+	low := c.maxSize / 10 * 9
+	sort.Sort(cacheEntriesByTime(entries))
+	for _, e := range entries {
+		if total <= low {
+			break
+		}
+		err := os.Remove(e.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= e.size
+	}
+	c.size = total
+	logf("action cache: evicted to %d bytes", total)
+	return nil
+}
+
+// copyFile copies src to dst with its permission. dst is replaced
+// atomically.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(dst)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(dir, ".kati_tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), fi.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
+
+// tieredCache looks up caches in order, and fills the earlier caches
+// with the outputs found in the later ones.
+type tieredCache []outputCache
+
+func (c tieredCache) get(key, output string) (bool, error) {
+	var firstErr error
+	for i, oc := range c {
+		hit, err := oc.get(key, output)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if !hit {
+			continue
+		}
+		for _, earlier := range c[:i] {
+			err := earlier.put(key, output)
+			if err != nil {
+				logf("action cache: %s: %v", output, err)
+			}
+		}
+		return true, nil
+	}
+	return false, firstErr
+}
+
+func (c tieredCache) put(key, output string) error {
+	var firstErr error
+	for _, oc := range c {
+		err := oc.put(key, output)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// writeFileAtomic writes b to filename through a temporary file in the
+// same directory, which is unique among processes sharing the cache.
+func writeFileAtomic(filename string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".kati_tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
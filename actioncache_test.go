@@ -0,0 +1,120 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestActionCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "actioncache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "foo.c")
+	output := filepath.Join(dir, "out", "foo.o")
+	err = ioutil.WriteFile(input, []byte("src"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &DepNode{Output: output, ActualInputs: []string{input}}
+	rr := []runner{{output: output, cmd: "cc -c foo.c", shell: "/bin/sh"}}
+	env := []string{"B=2", "A=1"}
+
+	key, err := actionKey(n, rr, env)
+	if err != nil {
+		t.Fatalf("actionKey(foo.o)=_, %v", err)
+	}
+	if k, _ := actionKey(n, rr, []string{"A=1", "B=2"}); k != key {
+		t.Errorf("actionKey depends on the order of env")
+	}
+	if k, _ := actionKey(n, []runner{{output: output, cmd: "cc -O2 -c foo.c", shell: "/bin/sh"}}, env); k == key {
+		t.Errorf("actionKey does not depend on commands")
+	}
+
+	c, err := newActionCache(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatalf("newActionCache=_, %v", err)
+	}
+	hit, err := c.get(key, output)
+	if hit || err != nil {
+		t.Errorf("get(%q)=%t, %v; want=false, <nil>", key, hit, err)
+	}
+	err = os.MkdirAll(filepath.Dir(output), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(output, []byte("obj"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.put(key, output)
+	if err != nil {
+		t.Fatalf("put(%q)=%v", key, err)
+	}
+	os.RemoveAll(filepath.Dir(output))
+	hit, err = c.get(key, output)
+	if !hit || err != nil {
+		t.Fatalf("get(%q)=%t, %v; want=true, <nil>", key, hit, err)
+	}
+	b, err := ioutil.ReadFile(output)
+	if err != nil || string(b) != "obj" {
+		t.Errorf("restored %s=%q, %v; want=%q", output, b, err, "obj")
+	}
+	if fi, err := os.Stat(output); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("mode of restored %s=%v, %v; want=%v", output, fi.Mode().Perm(), err, os.FileMode(0755))
+	}
+
+	entries, err := c.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, e := range entries {
+		size += e.size
+	}
+	if c.size != size {
+		t.Errorf("c.size=%d; want=%d", c.size, size)
+	}
+
+	// Make the entry older than a new one, which fills the cache.
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(c.acPath(key), old, old)
+	fis, _ := ioutil.ReadDir(filepath.Join(c.dir, "cas"))
+	for _, fi := range fis {
+		p := filepath.Join(c.dir, "cas", fi.Name())
+		os.Chtimes(p, old, old)
+	}
+	c.maxSize = 200
+	err = ioutil.WriteFile(output, make([]byte, 90), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.put("newkey", output)
+	if err != nil {
+		t.Fatalf("put(newkey)=%v", err)
+	}
+	if hit, _ := c.get(key, output); hit {
+		t.Errorf("get(%q)=true after eviction; want=false", key)
+	}
+	if hit, _ := c.get("newkey", output); !hit {
+		t.Errorf("get(newkey)=false; want=true")
+	}
+}
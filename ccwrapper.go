@@ -0,0 +1,58 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ccRE matches compile commands of the Android prebuilt toolchains. It
+// is the default of CCRegexp.
+var ccRE = regexp.MustCompile(`^prebuilts/(gcc|clang)/.*(gcc|g\+\+|clang|clang\+\+) .* -c `)
+
+// ccWrapper prefixes compile commands with a compiler launcher such as
+// ccache, distcc or gomacc.
+type ccWrapper struct {
+	launcher string
+	re       *regexp.Regexp
+}
+
+// newCCWrapper returns a ccWrapper to prefix commands matched by pat
+// with launcher. It returns nil if launcher is empty. If pat is empty,
+// ccRE is used.
+func newCCWrapper(launcher, pat string) (*ccWrapper, error) {
+	if launcher == "" {
+		return nil, nil
+	}
+	re := ccRE
+	if pat != "" {
+		var err error
+		re, err = regexp.Compile(pat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compile command regexp %q: %v", pat, err)
+		}
+	}
+	return &ccWrapper{launcher: launcher, re: re}, nil
+}
+
+// wrap returns cmd prefixed with the launcher if cmd is a compile
+// command. It reports whether cmd is wrapped.
+func (w *ccWrapper) wrap(cmd string) (string, bool) {
+	if w == nil || !w.re.MatchString(cmd) {
+		return cmd, false
+	}
+	return w.launcher + " " + cmd, true
+}
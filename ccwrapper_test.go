@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import "testing"
+
+func TestCCWrapper(t *testing.T) {
+	for _, tc := range []struct {
+		launcher string
+		pat      string
+		cmd      string
+		want     string
+		wrapped  bool
+	}{
+		{
+			launcher: "ccache",
+			cmd:      "prebuilts/clang/bin/clang -O2 -c foo.c -o foo.o",
+			want:     "ccache prebuilts/clang/bin/clang -O2 -c foo.c -o foo.o",
+			wrapped:  true,
+		},
+		{
+			launcher: "ccache",
+			cmd:      "cc -c foo.c -o foo.o",
+			want:     "cc -c foo.c -o foo.o",
+		},
+		{
+			launcher: "distcc",
+			pat:      `^(cc|c\+\+) .*-c `,
+			cmd:      "c++ -O2 -c foo.cc -o foo.o",
+			want:     "distcc c++ -O2 -c foo.cc -o foo.o",
+			wrapped:  true,
+		},
+		{
+			launcher: "distcc",
+			pat:      `^(cc|c\+\+) .*-c `,
+			cmd:      "c++ foo.o -o foo",
+			want:     "c++ foo.o -o foo",
+		},
+		{
+			cmd:  "cc -c foo.c -o foo.o",
+			want: "cc -c foo.c -o foo.o",
+		},
+	} {
+		w, err := newCCWrapper(tc.launcher, tc.pat)
+		if err != nil {
+			t.Errorf("newCCWrapper(%q, %q)=_, %v", tc.launcher, tc.pat, err)
+			continue
+		}
+		got, wrapped := w.wrap(tc.cmd)
+		if got != tc.want || wrapped != tc.wrapped {
+			t.Errorf("wrap(%q)=%q, %t; want=%q, %t", tc.cmd, got, wrapped, tc.want, tc.wrapped)
+		}
+	}
+
+	if _, err := newCCWrapper("ccache", "("); err == nil {
+		t.Errorf(`newCCWrapper("ccache", "(")=_, nil; want error`)
+	}
+}
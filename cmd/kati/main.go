@@ -16,14 +16,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -35,6 +38,22 @@ const shellDateTimeformat = time.RFC3339
 var (
 	makefileFlag string
 	jobsFlag     int
+	loadFlag     float64
+	maxMemFlag   int64
+	outputSync   string
+	showStatus   bool
+	buildMetrics string
+
+	criticalPathLog  string
+	contentHashState string
+	actionCache      string
+	actionCacheSize  int64
+
+	remoteCache        string
+	remoteCacheTimeout time.Duration
+
+	recipeTimeout time.Duration
+	stallWarning  time.Duration
 
 	loadJSON string
 	saveJSON string
@@ -52,8 +71,25 @@ var (
 	syntaxCheckOnlyFlag bool
 	queryFlag           string
 	eagerCmdEvalFlag    bool
+	parallelDepGraph    bool
 	generateNinja       bool
+	regenNinja          bool
+	regen               bool
+	ninjaDir            string
+	ninjaSuffix         string
+	subninjas           bool
 	gomaDir             string
+	ccWrapper           string
+	ccRegexp            string
+	remoteJobs          int
+	localPoolDepth      int
+	ninjaHermetic       bool
+	ninjaEnv            string
+	genCompDB           string
+	dumpGraph           string
+	dumpGraphRoots      string
+	dumpGraphDepth      int
+	compDBCompiler      string
 	findCachePrunes     string
 	findCacheLeafNames  string
 	shellDate           string
@@ -63,6 +99,18 @@ func init() {
 	// TODO: Make this default and replace this by -d flag.
 	flag.StringVar(&makefileFlag, "f", "", "Use it as a makefile")
 	flag.IntVar(&jobsFlag, "j", 1, "Allow N jobs at once.")
+	flag.Float64Var(&loadFlag, "l", 0, "Don't start multiple jobs unless load is below N.")
+	flag.Int64Var(&maxMemFlag, "max_mem", 0, "Don't start multiple jobs unless memory in use is below N megabytes.")
+	flag.StringVar(&outputSync, "output_sync", "", "Synchronize output of parallel jobs by `type`: none, line, target or recurse.")
+	flag.BoolVar(&showStatus, "show_status", false, "Show the progress of the build, formatted by $KATI_STATUS like $NINJA_STATUS.")
+	flag.DurationVar(&recipeTimeout, "recipe_timeout", 0, "Kill recipes which run longer than the duration. .KATI_TIMEOUT overrides it in seconds.")
+	flag.DurationVar(&stallWarning, "stall_warning", 0, "Warn about jobs which have produced no output for the duration.")
+	flag.StringVar(&criticalPathLog, "critical_path_log", "", "Schedule jobs by critical path, using durations recorded in `file`.")
+	flag.StringVar(&contentHashState, "content_hash_state", "", "Skip recipes whose inputs have the same contents, using digests recorded in `file`.")
+	flag.StringVar(&actionCache, "action_cache", "", "Restore outputs of .KATI_CACHEABLE targets from the cache in `dir`.")
+	flag.Int64Var(&actionCacheSize, "action_cache_size", 10240, "Limit the action cache to N megabytes.")
+	flag.StringVar(&remoteCache, "remote_cache", "", "Share outputs of .KATI_CACHEABLE targets through the Bazel HTTP cache at `url`.")
+	flag.DurationVar(&remoteCacheTimeout, "remote_cache_timeout", 10*time.Second, "Timeout of connecting to the remote cache and waiting for its responses.")
 
 	flag.StringVar(&loadGOB, "load", "", "")
 	flag.StringVar(&saveGOB, "save", "", "")
@@ -77,11 +125,29 @@ func init() {
 	flag.StringVar(&heapprofile, "kati_heapprofile", "", "write heap profile to `file`")
 	flag.StringVar(&memstats, "kati_memstats", "", "Show memstats with given templates")
 	flag.StringVar(&traceEventFile, "kati_trace_event", "", "write trace event to `file`")
+	flag.StringVar(&buildMetrics, "build_metrics", "", "write the summary of executed jobs to `file` in JSON")
 	flag.BoolVar(&syntaxCheckOnlyFlag, "c", false, "Syntax check only.")
 	flag.StringVar(&queryFlag, "query", "", "Show the target info")
+	flag.StringVar(&dumpGraph, "dump_graph", "", "Dump the dependency graph in `format`: dot or json.")
+	flag.StringVar(&dumpGraphRoots, "dump_graph_roots", "", "Space separated targets to start -dump_graph from, instead of the goals.")
+	flag.IntVar(&dumpGraphDepth, "dump_graph_depth", 0, "Limit -dump_graph to N levels of prerequisites from the roots.")
 	flag.BoolVar(&eagerCmdEvalFlag, "eager_cmd_eval", false, "Eval commands first.")
+	flag.BoolVar(&parallelDepGraph, "parallel_dep_graph", false, "Build the dependency graph in parallel.")
 	flag.BoolVar(&generateNinja, "ninja", false, "Generate build.ninja.")
+	flag.BoolVar(&regenNinja, "regen_ninja", false, "Regenerate build.ninja when makefiles, globs or the environment are changed.")
+	flag.StringVar(&ninjaDir, "ninja_dir", "", "The directory to write build.ninja and ninja.sh.")
+	flag.StringVar(&ninjaSuffix, "ninja_suffix", "", "The suffix of build.ninja and ninja.sh, e.g. build<suffix>.ninja.")
+	flag.BoolVar(&subninjas, "subninjas", false, "Split build.ninja into subninja files for each directory of makefiles.")
+	flag.BoolVar(&ninjaHermetic, "ninja_hermetic", false, "Run ninja with only the exported variables and -ninja_env in the environment.")
+	flag.StringVar(&ninjaEnv, "ninja_env", "HOME LANG PATH TERM TMPDIR USER", "Space separated variables kept by -ninja_hermetic.")
+	flag.BoolVar(&regen, "regen", false, "Regenerate build.ninja only if the makefiles, the environment or the flags are changed. Implies -regen_ninja.")
+	flag.StringVar(&genCompDB, "gen_compdb", "", "Write the compile commands to `file` as a JSON compilation database, without building.")
+	flag.StringVar(&compDBCompiler, "compdb_compiler", "", "The `regexp` to match compilers for -gen_compdb. The default matches gcc and clang.")
 	flag.StringVar(&gomaDir, "goma_dir", "", "If specified, use goma to build C/C++ files.")
+	flag.StringVar(&ccWrapper, "cc_wrapper", "", "Run compile commands with the launcher `cmd`, e.g. ccache.")
+	flag.StringVar(&ccRegexp, "cc_regexp", "", "The `regexp` to match compile commands for -cc_wrapper. The default matches the Android prebuilt compilers.")
+	flag.IntVar(&remoteJobs, "remote_jobs", 0, "Run N jobs at once in ninja.sh, for -cc_wrapper which compiles remotely.")
+	flag.IntVar(&localPoolDepth, "local_pool_depth", 0, "Run N commands not wrapped by -cc_wrapper at once in ninja. The default is the number of CPUs.")
 
 	flag.StringVar(&findCachePrunes, "find_cache_prunes", "",
 		"space separated prune directories for find cache.")
@@ -95,11 +161,13 @@ func init() {
 	flag.BoolVar(&kati.EvalStatsFlag, "kati_eval_stats", false, "Show eval statistics")
 
 	flag.BoolVar(&kati.DryRunFlag, "n", false, "Only print the commands that would be executed")
+	flag.BoolVar(&kati.WerrorCyclesFlag, "werror_cycles", false, "Make circular dependencies errors, with the full cycles.")
 
 	// TODO: Make this default.
 	flag.BoolVar(&kati.UseFindCache, "use_find_cache", false, "Use find cache.")
 	flag.BoolVar(&kati.UseWildcardCache, "use_wildcard_cache", true, "Use wildcard cache.")
 	flag.BoolVar(&kati.UseShellBuiltins, "use_shell_builtins", true, "Use shell builtins")
+	flag.BoolVar(&kati.PrefetchIncludesFlag, "prefetch_includes", false, "Parse included makefiles in parallel ahead of evaluation.")
 	flag.StringVar(&kati.IgnoreOptionalInclude, "ignore_optional_include", "", "If specified, skip reading -include directives start with the specified path.")
 }
 
@@ -217,6 +285,25 @@ func main() {
 	}
 }
 
+func ninjaOpt() kati.NinjaOpt {
+	opt := kati.NinjaOpt{
+		GomaDir:        gomaDir,
+		CCWrapper:      ccWrapper,
+		CCRegexp:       ccRegexp,
+		RemoteJobs:     remoteJobs,
+		LocalPoolDepth: localPoolDepth,
+		Dir:            ninjaDir,
+		Suffix:         ninjaSuffix,
+		Subninjas:      subninjas,
+		Hermetic:       ninjaHermetic,
+		HermeticEnv:    strings.Fields(ninjaEnv),
+	}
+	if regenNinja {
+		opt.Args = os.Args
+	}
+	return opt
+}
+
 func katiMain(args []string) error {
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
@@ -257,6 +344,19 @@ func katiMain(args []string) error {
 		kati.ShellDateTimestamp = t
 	}
 
+	if regen {
+		// The stamp to check is written with -regen_ninja.
+		regenNinja = true
+	}
+	if regen && generateNinja {
+		reason := kati.NinjaRegenReason(ninjaOpt())
+		if reason == "" {
+			fmt.Println("kati: build.ninja is up to date")
+			return nil
+		}
+		fmt.Printf("kati: regenerating build.ninja: %s\n", reason)
+	}
+
 	var leafNames []string
 	if findCacheLeafNames != "" {
 		leafNames = strings.Fields(findCacheLeafNames)
@@ -273,6 +373,8 @@ func katiMain(args []string) error {
 	req.EnvironmentVars = os.Environ()
 	req.UseCache = useCache
 	req.EagerEvalCommand = eagerCmdEvalFlag
+	req.ParallelDepGraph = parallelDepGraph
+	req.TrackAccesses = generateNinja && regenNinja
 
 	g, cached, err := load(req)
 	if err != nil {
@@ -286,8 +388,15 @@ func katiMain(args []string) error {
 		}
 	}
 
+	if genCompDB != "" {
+		err = kati.GenerateCompDB(g, genCompDB, kati.CompDBOpt{Compiler: compDBCompiler})
+		if err != nil || !generateNinja {
+			return err
+		}
+	}
+
 	if generateNinja {
-		return kati.GenerateNinja(g, gomaDir)
+		return kati.GenerateNinjaWithOpt(g, ninjaOpt())
 	}
 
 	if syntaxCheckOnlyFlag {
@@ -299,14 +408,54 @@ func katiMain(args []string) error {
 		return nil
 	}
 
+	if dumpGraph != "" {
+		return kati.DumpGraph(os.Stdout, g, kati.GraphDumpOpt{
+			Format: dumpGraph,
+			Roots:  strings.Fields(dumpGraphRoots),
+			Depth:  dumpGraphDepth,
+		})
+	}
+
 	execOpt := &kati.ExecutorOpt{
-		NumJobs: jobsFlag,
+		NumJobs:          jobsFlag,
+		MaxLoad:          loadFlag,
+		MaxMem:           maxMemFlag * 1024 * 1024,
+		OutputSync:       outputSync,
+		ShowStatus:       showStatus,
+		BuildMetrics:     buildMetrics,
+		CriticalPathLog:  criticalPathLog,
+		ContentHashState: contentHashState,
+		ActionCache:      actionCache,
+		ActionCacheSize:  actionCacheSize * 1024 * 1024,
+
+		RemoteCache:        remoteCache,
+		RemoteCacheTimeout: remoteCacheTimeout,
+
+		RecipeTimeout: recipeTimeout,
+		StallWarning:  stallWarning,
+
+		CCWrapper: ccWrapper,
+		CCRegexp:  ccRegexp,
 	}
 	ex, err := kati.NewExecutor(execOpt)
 	if err != nil {
 		return err
 	}
-	err = ex.Exec(g)
+	// Kill running commands on Ctrl-C, as they are not in our
+	// process group.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	go func() {
+		select {
+		case <-sigc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	_, err = ex.ExecContext(ctx, g)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,306 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// compilerRE matches the C/C++/ObjC compilers, which are the first
+// words of compile commands. It is the default of CompDBOpt.Compiler.
+var compilerRE = regexp.MustCompile(`(^|/)([a-z0-9_]+-)*(cc|c\+\+|gcc|g\+\+|clang|clang\+\+)(-[0-9.]+)?$`)
+
+// sourceExts are the extensions of the source files of compile
+// commands.
+var sourceExts = map[string]bool{
+	".c":   true,
+	".cc":  true,
+	".cp":  true,
+	".cpp": true,
+	".cxx": true,
+	".c++": true,
+	".C":   true,
+	".m":   true,
+	".mm":  true,
+	".S":   true,
+}
+
+// CompDBOpt is an option for GenerateCompDB.
+type CompDBOpt struct {
+	// Compiler matches the compilers. If empty, gcc and clang are
+	// matched, with a target prefix or a version suffix.
+	Compiler string
+}
+
+// compDBEntry is an entry of the JSON compilation database.
+// http://clang.llvm.org/docs/JSONCompilationDatabase.html
+type compDBEntry struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Output    string   `json:"output,omitempty"`
+	Arguments []string `json:"arguments"`
+}
+
+// GenerateCompDB writes the compile commands in g to filename as a
+// JSON compilation database. No commands are executed.
+func GenerateCompDB(g *DepGraph, filename string, opt CompDBOpt) error {
+	re := compilerRE
+	if opt.Compiler != "" {
+		var err error
+		re, err = regexp.Compile(opt.Compiler)
+		if err != nil {
+			return fmt.Errorf("invalid compiler regexp %q: %v", opt.Compiler, err)
+		}
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	entries, err := compileCommands(g, re, dir)
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = []compDBEntry{}
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// compileCommands returns the compile commands of the nodes in g in
+// the order of the traversal.
+func compileCommands(g *DepGraph, re *regexp.Regexp, dir string) ([]compDBEntry, error) {
+	ctx := newExecContext(g.vars, true)
+	done := make(map[string]bool)
+	var entries []compDBEntry
+	var walk func(n *DepNode) error
+	walk = func(n *DepNode) error {
+		if done[n.Output] {
+			return nil
+		}
+		done[n.Output] = true
+		runners, _, err := createRunners(ctx, n)
+		if err != nil {
+			return err
+		}
+		for _, r := range runners {
+			// Each recipe line runs in its own shell, which
+			// starts in dir and may change it by cd.
+			cwd := dir
+			for _, args := range splitShellCommands(r.cmd) {
+				if args[0] == "cd" {
+					cwd = cdDir(cwd, args)
+					continue
+				}
+				if cwd == "" {
+					continue
+				}
+				e, ok := compileCommand(args, re)
+				if !ok {
+					continue
+				}
+				e.Directory = cwd
+				if e.Output == "" {
+					e.Output = n.Output
+					if cwd != dir && !filepath.IsAbs(e.Output) {
+						e.Output = filepath.Join(dir, e.Output)
+					}
+				}
+				entries = append(entries, e)
+			}
+		}
+		for _, d := range n.Deps {
+			if err := walk(d); err != nil {
+				return err
+			}
+		}
+		for _, d := range n.OrderOnlys {
+			if err := walk(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, n := range g.nodes {
+		if err := walk(n); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// compileCommand returns the entry for args if it is a compile command,
+// without the output if it is not given. Environment variable
+// assignments and a launcher such as ccache before the compiler are
+// dropped.
+func compileCommand(args []string, re *regexp.Regexp) (compDBEntry, bool) {
+	for len(args) > 0 && shellVarAssignRE.MatchString(args[0]) {
+		args = args[1:]
+	}
+	if len(args) > 1 && !re.MatchString(args[0]) && re.MatchString(args[1]) {
+		args = args[1:]
+	}
+	if len(args) == 0 || !re.MatchString(args[0]) || !contains(args, "-c") {
+		return compDBEntry{}, false
+	}
+	e := compDBEntry{Arguments: args}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o" && i+1 < len(args):
+			i++
+			e.Output = args[i]
+		case strings.HasPrefix(arg, "-o") && len(arg) > 2:
+			e.Output = arg[2:]
+		case strings.HasPrefix(arg, "-"):
+		case e.File == "" && sourceExts[filepath.Ext(arg)]:
+			e.File = arg
+		}
+	}
+	if e.File == "" {
+		return compDBEntry{}, false
+	}
+	return e, true
+}
+
+// cdDir returns the directory after the cd command args in dir, or ""
+// if it is unknown, e.g. the directory has an expansion. Subshells are
+// not taken into account.
+func cdDir(dir string, args []string) string {
+	if len(args) != 2 {
+		return ""
+	}
+	arg := args[1]
+	if arg == "" || strings.ContainsAny(arg, "$`~*?[") || strings.HasPrefix(arg, "-") {
+		return ""
+	}
+	if filepath.IsAbs(arg) {
+		return filepath.Clean(arg)
+	}
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, arg)
+}
+
+var shellVarAssignRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// splitShellCommands splits a shell script into the words of simple
+// commands, which are separated by ;, &, |, newlines or parentheses.
+// Quotes and backslashes are removed. Expansions are kept as is.
+func splitShellCommands(s string) [][]string {
+	var cmds [][]string
+	var args []string
+	var word []byte
+	inWord := false
+	endWord := func() {
+		if inWord {
+			args = append(args, string(word))
+			word = word[:0]
+			inWord = false
+		}
+	}
+	endCmd := func() {
+		endWord()
+		if len(args) > 0 {
+			cmds = append(cmds, args)
+			args = nil
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch ch {
+		case ' ', '\t':
+			endWord()
+		case '\n', ';', '&', '|', '(', ')':
+			endCmd()
+		case '\\':
+			i++
+			if i < len(s) && s[i] != '\n' {
+				word = append(word, s[i])
+				inWord = true
+			}
+		case '\'':
+			inWord = true
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				j = len(s) - i - 1
+			}
+			word = append(word, s[i+1:i+1+j]...)
+			i += j + 1
+		case '"':
+			inWord = true
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				word = append(word, s[i])
+			}
+		case '$':
+			inWord = true
+			if i+1 >= len(s) || s[i+1] != '(' {
+				word = append(word, ch)
+				continue
+			}
+			// Keep a command substitution in the word.
+			depth := 0
+			for ; i < len(s); i++ {
+				word = append(word, s[i])
+				if s[i] == '(' {
+					depth++
+				} else if s[i] == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case '#':
+			if !inWord {
+				// A comment until the end of the line.
+				for i < len(s) && s[i] != '\n' {
+					i++
+				}
+				endCmd()
+				continue
+			}
+			word = append(word, ch)
+		default:
+			word = append(word, ch)
+			inWord = true
+		}
+	}
+	endCmd()
+	return cmds
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellCommands(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want [][]string
+	}{
+		{
+			in:   "cc -c foo.c -o foo.o",
+			want: [][]string{{"cc", "-c", "foo.c", "-o", "foo.o"}},
+		},
+		{
+			in: `mkdir -p out && (cd out; cc -DX='"a b"' "-I$x" -c ../a\ b.c) | tee log`,
+			want: [][]string{
+				{"mkdir", "-p", "out"},
+				{"cd", "out"},
+				{"cc", `-DX="a b"`, "-I$x", "-c", "../a b.c"},
+				{"tee", "log"},
+			},
+		},
+		{
+			in:   "cc -c \\\n foo.c # comment; rm foo.c\necho \"\\\"$(date +%s)\\\"\"",
+			want: [][]string{{"cc", "-c", "foo.c"}, {"echo", `"$(date +%s)"`}},
+		},
+		{
+			in:   "echo $(basename $(dir a/b)) done",
+			want: [][]string{{"echo", "$(basename $(dir a/b))", "done"}},
+		},
+	} {
+		got := splitShellCommands(tc.in)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitShellCommands(%q)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestGenerateCompDB(t *testing.T) {
+	_, cleanup := chdirTemp(t, "compdb")
+	defer cleanup()
+	err := ioutil.WriteFile("Makefile", []byte(`CC := arm-linux-gnueabi-gcc-4.9
+all: prog
+prog: main.o util.o sub/a.o
+	$(CC) $^ -o $@
+main.o: main.c
+	@mkdir -p out && $(CC) -O2 -c $< -o $@
+util.o: util.cc
+	CCACHE_DIR=/tmp ccache clang++ -std=c++11 -c -outil.o $<
+sub/a.o: sub/a.c
+	cd sub && cc -c a.c && cd /tmp && cc -c b.c
+	cd $$HOME && cc -c c.c
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenerateCompDB(g, "compile_commands.json", CompDBOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("compile_commands.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []compDBEntry
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("compile_commands.json: %v\n%s", err, b)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []compDBEntry{
+		{
+			Directory: cwd,
+			File:      "main.c",
+			Output:    "main.o",
+			Arguments: []string{"arm-linux-gnueabi-gcc-4.9", "-O2", "-c", "main.c", "-o", "main.o"},
+		},
+		{
+			Directory: cwd,
+			File:      "util.cc",
+			Output:    "util.o",
+			Arguments: []string{"clang++", "-std=c++11", "-c", "-outil.o", "util.cc"},
+		},
+		{
+			Directory: filepath.Join(cwd, "sub"),
+			File:      "a.c",
+			Output:    filepath.Join(cwd, "sub/a.o"),
+			Arguments: []string{"cc", "-c", "a.c"},
+		},
+		{
+			Directory: "/tmp",
+			File:      "b.c",
+			Output:    filepath.Join(cwd, "sub/a.o"),
+			Arguments: []string{"cc", "-c", "b.c"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("compile_commands.json=%q; want=%q", got, want)
+	}
+	if _, err := os.Stat("out"); err == nil {
+		t.Errorf("GenerateCompDB ran a command")
+	}
+}
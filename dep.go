@@ -15,9 +15,12 @@
 package kati
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
 // DepNode represents a makefile rule for an output.
@@ -29,6 +32,7 @@ type DepNode struct {
 	Parents            []*DepNode
 	HasRule            bool
 	IsPhony            bool
+	IsCacheable        bool
 	ActualInputs       []string
 	TargetSpecificVars Vars
 	Filename           string
@@ -52,13 +56,23 @@ type depBuilder struct {
 	ev          *Evaluator
 	done        map[string]*DepNode
 	phony       map[string]bool
-
-	trace                         []string
-	nodeCnt                       int
-	pickExplicitRuleCnt           int
-	pickImplicitRuleCnt           int
-	pickSuffixRuleCnt             int
-	pickExplicitRuleWithoutCmdCnt int
+	cacheable   map[string]bool
+	// parallel makes Eval pick rules in parallel.
+	parallel bool
+
+	// building has the rules of the targets in db.trace.
+	building map[string]*rule
+
+	trace []string
+	// cycles has the warnings of circular dependencies.
+	cycles  []string
+	nodeCnt int
+	// pick*Cnt are updated atomically, as rules may be picked in
+	// parallel.
+	pickExplicitRuleCnt           int64
+	pickImplicitRuleCnt           int64
+	pickSuffixRuleCnt             int64
+	pickExplicitRuleWithoutCmdCnt int64
 }
 
 type ruleTrieEntry struct {
@@ -132,7 +146,7 @@ func replaceSuffix(s string, newsuf string) string {
 	return fmt.Sprintf("%s.%s", stripExt(s), newsuf)
 }
 
-func (db *depBuilder) exists(target string) bool {
+func (db *depBuilder) exists(ev *Evaluator, target string) bool {
 	_, present := db.rules[target]
 	if present {
 		return true
@@ -140,18 +154,18 @@ func (db *depBuilder) exists(target string) bool {
 	if db.phony[target] {
 		return true
 	}
-	_, ok := existsInVPATH(db.ev, target)
+	_, ok := existsInVPATH(ev, target)
 	return ok
 }
 
-func (db *depBuilder) canPickImplicitRule(r *rule, output string) bool {
+func (db *depBuilder) canPickImplicitRule(ev *Evaluator, r *rule, output string) bool {
 	outputPattern := r.outputPatterns[0]
 	if !outputPattern.match(output) {
 		return false
 	}
 	for _, input := range r.inputs {
 		input = outputPattern.subst(input, output)
-		if !db.exists(input) {
+		if !db.exists(ev, input) {
 			return false
 		}
 	}
@@ -179,35 +193,38 @@ func (db *depBuilder) mergeImplicitRuleVars(outputs []string, vars Vars) Vars {
 	return v
 }
 
-func (db *depBuilder) pickRule(output string) (*rule, Vars, bool) {
+// pickRule picks the rule for output. It may be called concurrently
+// with different ev.
+func (db *depBuilder) pickRule(ev *Evaluator, output string) (*rule, Vars, bool) {
 	r, present := db.rules[output]
 	vars := db.ruleVars[output]
 	if present {
-		db.pickExplicitRuleCnt++
+		atomic.AddInt64(&db.pickExplicitRuleCnt, 1)
 		if len(r.cmds) > 0 {
 			return r, vars, true
 		}
 		// If none of the explicit rules for a target has commands,
 		// then `make' searches for an applicable implicit rule to
 		// find some commands.
-		db.pickExplicitRuleWithoutCmdCnt++
+		atomic.AddInt64(&db.pickExplicitRuleWithoutCmdCnt, 1)
 	}
 
 	irules := db.implicitRules.lookup(output)
 	for i := len(irules) - 1; i >= 0; i-- {
 		irule := irules[i]
-		if !db.canPickImplicitRule(irule, output) {
+		if !db.canPickImplicitRule(ev, irule, output) {
 			logf("ignore implicit rule %q %s", output, irule)
 			continue
 		}
 		logf("pick implicit rule %q => %q %s", output, irule.outputPatterns, irule)
-		db.pickImplicitRuleCnt++
+		atomic.AddInt64(&db.pickImplicitRuleCnt, 1)
 		if r != nil {
 			ir := &rule{}
 			*ir = *r
 			ir.outputPatterns = irule.outputPatterns
 			// implicit rule's prerequisites will be used for $<
-			ir.inputs = append(irule.inputs, ir.inputs...)
+			// Copy not to share the backing array of irule.inputs.
+			ir.inputs = append(append([]string(nil), irule.inputs...), ir.inputs...)
 			ir.cmds = irule.cmds
 			// TODO(ukai): filename, lineno?
 			ir.cmdLineno = irule.cmdLineno
@@ -237,10 +254,10 @@ func (db *depBuilder) pickRule(output string) (*rule, Vars, bool) {
 			// TODO(ukai): should return error?
 			panic(fmt.Sprintf("FIXME: unexpected number of input for a suffix rule (%d)", len(irule.inputs)))
 		}
-		if !db.exists(replaceSuffix(output, irule.inputs[0])) {
+		if !db.exists(ev, replaceSuffix(output, irule.inputs[0])) {
 			continue
 		}
-		db.pickSuffixRuleCnt++
+		atomic.AddInt64(&db.pickSuffixRuleCnt, 1)
 		if r != nil {
 			sr := &rule{}
 			*sr = *r
@@ -268,17 +285,25 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 	}
 
 	if n, present := db.done[output]; present {
+		if _, ok := db.building[output]; ok {
+			err := db.reportCycle(output)
+			if err != nil {
+				return nil, err
+			}
+		}
 		return n, nil
 	}
 
-	n := &DepNode{Output: output, IsPhony: db.phony[output]}
+	n := &DepNode{Output: output, IsPhony: db.phony[output], IsCacheable: db.cacheable[output]}
 	db.done[output] = n
 
 	// create depnode for phony targets?
-	rule, vars, present := db.pickRule(output)
+	rule, vars, present := db.pickRule(db.ev, output)
 	if !present {
 		return n, nil
 	}
+	db.building[output] = rule
+	defer delete(db.building, output)
 
 	var restores []func()
 	if vars != nil {
@@ -375,6 +400,45 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 	return n, nil
 }
 
+// reportCycle reports the circular dependency which ends at output,
+// with the locations of the rules. It is a warning in GNU make's
+// format unless WerrorCyclesFlag is set. Cycles through phony targets
+// are not reported, as in GNU make.
+func (db *depBuilder) reportCycle(output string) error {
+	if db.phony[output] {
+		return nil
+	}
+	// db.trace ends with output, which is also an ancestor.
+	start := 0
+	for i := len(db.trace) - 2; i >= 0; i-- {
+		if db.trace[i] == output {
+			start = i
+			break
+		}
+	}
+	cycle := db.trace[start:]
+	var buf bytes.Buffer
+	buf.WriteString("circular dependency: ")
+	for i, target := range cycle {
+		if i > 0 {
+			buf.WriteString(" -> ")
+		}
+		buf.WriteString(target)
+		if r := db.building[target]; r != nil && i < len(cycle)-1 {
+			fmt.Fprintf(&buf, " (%s)", r.srcpos)
+		}
+	}
+	if WerrorCyclesFlag {
+		return errors.New(buf.String())
+	}
+	neededBy := output
+	if len(db.trace) >= 2 {
+		neededBy = db.trace[len(db.trace)-2]
+	}
+	db.cycles = append(db.cycles, fmt.Sprintf("Circular %s <- %s dependency dropped.\n*kati*: %s\n", neededBy, output, buf.String()))
+	return nil
+}
+
 func (db *depBuilder) populateSuffixRule(r *rule, output string) bool {
 	if len(output) == 0 || output[0] != '.' {
 		return false
@@ -505,6 +569,8 @@ func newDepBuilder(er *evalResult, vars Vars) (*depBuilder, error) {
 		ev:            NewEvaluator(vars),
 		done:          make(map[string]*DepNode),
 		phony:         make(map[string]bool),
+		cacheable:     make(map[string]bool),
+		building:      make(map[string]*rule),
 	}
 
 	err := db.populateRules(er)
@@ -517,6 +583,14 @@ func newDepBuilder(er *evalResult, vars Vars) (*depBuilder, error) {
 			db.phony[input] = true
 		}
 	}
+	// Outputs of .KATI_CACHEABLE targets can be restored from the
+	// action cache.
+	rule, present = db.rules[".KATI_CACHEABLE"]
+	if present {
+		for _, input := range rule.inputs {
+			db.cacheable[input] = true
+		}
+	}
 	return db, nil
 }
 
@@ -533,10 +607,24 @@ func (db *depBuilder) Eval(targets []string) ([]*DepNode, error) {
 	logStats("%d implicit rules", db.implicitRules.size())
 	logStats("%d suffix rules", len(db.suffixRules))
 
+	var pm *planMap
+	if db.parallel {
+		if db.hasTargetSpecificVPATH() {
+			logf("target specific VPATH: build dep graph serially")
+		} else {
+			pm = db.planRules(targets)
+		}
+	}
 	var nodes []*DepNode
 	for _, target := range targets {
 		db.trace = []string{target}
-		n, err := db.buildPlan(target, "", make(Vars))
+		var n *DepNode
+		var err error
+		if pm != nil {
+			n, err = db.buildPlanned(pm, target, make(Vars))
+		} else {
+			n, err = db.buildPlan(target, "", make(Vars))
+		}
 		if err != nil {
 			return nil, err
 		}
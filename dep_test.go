@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCircularDependency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	makefile := filepath.Join(dir, "Makefile")
+	err = ioutil.WriteFile(makefile, []byte(`all: a p
+a: b
+b: c
+	touch $@
+c: a d
+d:
+p: q
+q: p
+.PHONY: p q
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(orig bool) { WerrorCyclesFlag = orig }(WerrorCyclesFlag)
+	WerrorCyclesFlag = false
+	g, err := Load(LoadReq{Makefile: makefile})
+	if err != nil {
+		t.Fatalf("Load()=_, %v without -werror_cycles; want <nil>", err)
+	}
+	var buf bytes.Buffer
+	g.reportCycles(&buf)
+	want := fmt.Sprintf(`Circular c <- a dependency dropped.
+*kati*: circular dependency: a (%[1]s:2) -> b (%[1]s:3) -> c (%[1]s:5) -> a
+`, makefile)
+	if got := buf.String(); got != want {
+		t.Errorf("cycles=%q without -werror_cycles; want=%q", got, want)
+	}
+
+	WerrorCyclesFlag = true
+	_, err = Load(LoadReq{Makefile: makefile})
+	want = fmt.Sprintf("circular dependency: a (%[1]s:2) -> b (%[1]s:3) -> c (%[1]s:5) -> a", makefile)
+	if err == nil || err.Error() != want {
+		t.Errorf("Load()=_, %v; want=%q", err, want)
+	}
+}
+
+func TestParallelDepGraph(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		files    []string
+		makefile string
+	}{
+		{
+			name:  "rules",
+			files: []string{"a.c", "b.c", "c.y", "d.c", "gen.in"},
+			makefile: `CFLAGS := -O2
+LIBS = -lm
+all: prog lib.a | stamp
+prog: CFLAGS += -DPROG
+prog: LIBS ?= -lc
+prog: a.o b.o c.o
+	cc -o $@ $^ $(LIBS)
+lib.a: CFLAGS := -fPIC
+lib.a: b.o d.o
+	ar rcs $@ $^
+a.o: gen.h
+gen.h: gen.in
+	cp $< $@
+%.o: %.c
+	cc $(CFLAGS) -c $< -o $@
+.SUFFIXES: .y .c
+.y.c:
+	yacc $< -o $@
+stamp:
+	touch $@
+.PHONY: all
+`,
+		},
+		{
+			// x.o is built by the implicit rule only if x.c is
+			// found in the VPATH of prog.
+			name:  "target specific VPATH",
+			files: []string{"src/x.c"},
+			makefile: `prog: VPATH := src
+prog: x.o
+	cc -o $@ $^
+%.o: %.c
+	cc -c $< -o $@
+`,
+		},
+	} {
+		func() {
+			_, cleanup := chdirTemp(t, "dep")
+			defer cleanup()
+			for _, f := range tc.files {
+				err := os.MkdirAll(filepath.Dir(f), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = ioutil.WriteFile(f, nil, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := ioutil.WriteFile("Makefile", []byte(tc.makefile), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var graphs []string
+			for _, parallel := range []bool{false, true} {
+				g, err := Load(LoadReq{Makefile: "Makefile", ParallelDepGraph: parallel})
+				if err != nil {
+					t.Fatalf("%s: Load(parallel=%t)=_, %v", tc.name, parallel, err)
+				}
+				sg, err := makeSerializableGraph(g, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := json.MarshalIndent(sg, "", " ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				graphs = append(graphs, string(b))
+			}
+			if graphs[0] != graphs[1] {
+				t.Errorf("%s: parallel dep graph differs:\n%s\nwant:\n%s", tc.name, graphs[1], graphs[0])
+			}
+		}()
+	}
+}
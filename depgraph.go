@@ -17,6 +17,7 @@ package kati
 import (
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"strings"
 	"time"
@@ -24,10 +25,14 @@ import (
 
 // DepGraph represents rules defined in makefiles.
 type DepGraph struct {
-	nodes       []*DepNode
-	vars        Vars
-	accessedMks []*accessedMakefile
-	exports     map[string]bool
+	nodes         []*DepNode
+	vars          Vars
+	accessedMks   []*accessedMakefile
+	accessedGlobs []*accessedGlob
+	accessedFinds []*accessedFind
+	usedEnvs      []string
+	exports       map[string]bool
+	cycles        []string
 }
 
 // Nodes returns all rules.
@@ -36,6 +41,13 @@ func (g *DepGraph) Nodes() []*DepNode { return g.nodes }
 // Vars returns all variables.
 func (g *DepGraph) Vars() Vars { return g.vars }
 
+// reportCycles writes the warnings of circular dependencies to w.
+func (g *DepGraph) reportCycles(w io.Writer) {
+	for _, c := range g.cycles {
+		io.WriteString(w, c)
+	}
+}
+
 // LoadReq is a request to load makefile.
 type LoadReq struct {
 	Makefile         string
@@ -44,6 +56,11 @@ type LoadReq struct {
 	EnvironmentVars  []string
 	UseCache         bool
 	EagerEvalCommand bool
+	// ParallelDepGraph builds the dependency graph in parallel.
+	ParallelDepGraph bool
+	// TrackAccesses records the makefiles, globs and environment
+	// variables accessed, to regenerate build.ninja.
+	TrackAccesses bool
 }
 
 // FromCommandLine creates LoadReq from given command line.
@@ -130,7 +147,7 @@ func Load(req LoadReq) (*DepGraph, error) {
 	if err != nil {
 		return nil, err
 	}
-	er, err := eval(mk, vars, req.UseCache)
+	er, err := eval(mk, vars, req.UseCache || req.TrackAccesses)
 	if err != nil {
 		return nil, err
 	}
@@ -144,6 +161,7 @@ func Load(req LoadReq) (*DepGraph, error) {
 	if err != nil {
 		return nil, err
 	}
+	db.parallel = req.ParallelDepGraph
 	logStats("dep build prepare time: %q", time.Since(startTime))
 
 	startTime = time.Now()
@@ -161,10 +179,14 @@ func Load(req LoadReq) (*DepGraph, error) {
 	})
 	accessedMks = append(accessedMks, er.accessedMks...)
 	gd := &DepGraph{
-		nodes:       nodes,
-		vars:        vars,
-		accessedMks: accessedMks,
-		exports:     er.exports,
+		nodes:         nodes,
+		vars:          vars,
+		accessedMks:   accessedMks,
+		accessedGlobs: er.accessedGlobs,
+		accessedFinds: er.accessedFinds,
+		usedEnvs:      er.usedEnvs,
+		exports:       er.exports,
+		cycles:        db.cycles,
 	}
 	if req.EagerEvalCommand {
 		startTime := time.Now()
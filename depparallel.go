@@ -0,0 +1,318 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"sync"
+)
+
+// The parallel dependency builder builds the same DepNode graph as
+// depBuilder.buildPlan in two phases:
+//
+//  1. Rules are picked for all reachable targets in parallel. This
+//     is where most of the time goes, as picking implicit and suffix
+//     rules checks the existence of files.
+//  2. DepNodes are created by a depth first search in the same order
+//     as buildPlan, as target specific variables are inherited from
+//     the first parent which reaches a target. Scopes of target
+//     specific variables are passed down without modification.
+//
+// As target specific variables are not known in the first phase, Eval
+// falls back to buildPlan when any target has a specific VPATH, which
+// affects picking rules of its prerequisites.
+
+// plannedRule is the rule picked for a target in the first phase.
+type plannedRule struct {
+	rule    *rule
+	vars    Vars
+	present bool
+	// inputs are the actual inputs of the rule.
+	inputs []string
+	// panicked is the panic in the first phase, which is raised again
+	// in the second phase on the main goroutine.
+	panicked interface{}
+}
+
+const planShards = 64
+
+// planMap is a concurrent map from targets to plannedRules.
+type planMap struct {
+	shards [planShards]struct {
+		mu sync.Mutex
+		m  map[string]*plannedRule
+	}
+}
+
+func newPlanMap() *planMap {
+	pm := &planMap{}
+	for i := range pm.shards {
+		pm.shards[i].m = make(map[string]*plannedRule)
+	}
+	return pm
+}
+
+func (pm *planMap) shard(target string) int {
+	h := fnv.New32a()
+	h.Write([]byte(target))
+	return int(h.Sum32() % planShards)
+}
+
+// claim returns the plannedRule for target, and reports whether it is
+// newly added.
+func (pm *planMap) claim(target string) (*plannedRule, bool) {
+	s := &pm.shards[pm.shard(target)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.m[target]; ok {
+		return p, false
+	}
+	p := &plannedRule{}
+	s.m[target] = p
+	return p, true
+}
+
+func (pm *planMap) get(target string) *plannedRule {
+	s := &pm.shards[pm.shard(target)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[target]
+}
+
+// planRules picks rules for targets and their prerequisites in
+// parallel, by runtime.NumCPU() workers.
+func (db *depBuilder) planRules(targets []string) *planMap {
+	pm := newPlanMap()
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	var queue []string
+	// pending is the number of targets queued or being planned.
+	pending := 0
+	visit := func(target string) {
+		if _, added := pm.claim(target); !added {
+			return
+		}
+		mu.Lock()
+		queue = append(queue, target)
+		pending++
+		mu.Unlock()
+		cond.Signal()
+	}
+	for _, target := range targets {
+		visit(target)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each worker has its own Evaluator to check VPATH.
+			ev := NewEvaluator(db.vars)
+			for {
+				mu.Lock()
+				for len(queue) == 0 && pending > 0 {
+					cond.Wait()
+				}
+				if pending == 0 {
+					mu.Unlock()
+					return
+				}
+				target := queue[len(queue)-1]
+				queue = queue[:len(queue)-1]
+				mu.Unlock()
+
+				p := pm.get(target)
+				db.planRule(ev, target, p)
+				if p.present {
+					for _, input := range p.inputs {
+						visit(input)
+					}
+					for _, input := range p.rule.orderOnlyInputs {
+						visit(input)
+					}
+				}
+
+				mu.Lock()
+				pending--
+				if pending == 0 {
+					cond.Broadcast()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return pm
+}
+
+// hasTargetSpecificVPATH reports whether any target has a specific
+// VPATH, which planRules can't take into account.
+func (db *depBuilder) hasTargetSpecificVPATH() bool {
+	for _, vars := range db.ruleVars {
+		if _, ok := vars["VPATH"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *depBuilder) planRule(ev *Evaluator, output string, p *plannedRule) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.panicked = r
+			p.present = false
+		}
+	}()
+	p.rule, p.vars, p.present = db.pickRule(ev, output)
+	if !p.present {
+		return
+	}
+	rule := p.rule
+	for _, input := range rule.inputs {
+		if len(rule.outputPatterns) > 0 {
+			if len(rule.outputPatterns) > 1 {
+				panic(fmt.Sprintf("FIXME: multiple output pattern is not supported yet"))
+			}
+			input = intern(rule.outputPatterns[0].subst(input, output))
+		} else if rule.isSuffixRule {
+			input = intern(replaceSuffix(output, input))
+		}
+		p.inputs = append(p.inputs, input)
+	}
+}
+
+// withTargetSpecificVars returns a new scope of target specific
+// variables, which is tsvs updated by vars. tsvs is not modified.
+func (db *depBuilder) withTargetSpecificVars(tsvs Vars, vars Vars) (Vars, error) {
+	scope := make(Vars, len(tsvs)+len(vars))
+	for k, v := range tsvs {
+		scope[k] = v
+	}
+	// Values are appended in the scope, as buildPlan does with
+	// db.vars updated by target specific variables.
+	ev := NewEvaluator(db.vars)
+	ev.currentScope = scope
+	lookup := func(name string) (Var, bool) {
+		if v, ok := scope[name]; ok {
+			return v, true
+		}
+		v, ok := db.vars[name]
+		return v, ok
+	}
+	for name, v := range vars {
+		tsv := v.(*targetSpecificVar)
+		switch tsv.op {
+		case ":=", "=":
+			scope[name] = v
+		case "+=":
+			oldVar, present := lookup(name)
+			if !present || oldVar.String() == "" {
+				scope[name] = v
+				continue
+			}
+			nv, err := oldVar.AppendVar(ev, tsv)
+			if err != nil {
+				return nil, err
+			}
+			scope[name] = nv
+		case "?=":
+			if _, present := lookup(name); !present {
+				scope[name] = v
+			}
+		}
+	}
+	return scope, nil
+}
+
+// buildPlanned is buildPlan with rules picked by planRules.
+func (db *depBuilder) buildPlanned(pm *planMap, output string, tsvs Vars) (*DepNode, error) {
+	db.nodeCnt++
+	if db.nodeCnt%100 == 0 {
+		db.reportStats()
+	}
+
+	if n, present := db.done[output]; present {
+		if _, ok := db.building[output]; ok {
+			err := db.reportCycle(output)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	}
+
+	n := &DepNode{Output: output, IsPhony: db.phony[output], IsCacheable: db.cacheable[output]}
+	db.done[output] = n
+
+	p := pm.get(output)
+	if p.panicked != nil {
+		panic(p.panicked)
+	}
+	if !p.present {
+		return n, nil
+	}
+	rule := p.rule
+	db.building[output] = rule
+	defer delete(db.building, output)
+
+	if p.vars != nil {
+		var err error
+		tsvs, err = db.withTargetSpecificVars(tsvs, p.vars)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, input := range p.inputs {
+		db.trace = append(db.trace, input)
+		ni, err := db.buildPlanned(pm, input, tsvs)
+		db.trace = db.trace[0 : len(db.trace)-1]
+		if err != nil {
+			return nil, err
+		}
+		n.Deps = append(n.Deps, ni)
+		ni.Parents = append(ni.Parents, n)
+	}
+	for _, input := range rule.orderOnlyInputs {
+		db.trace = append(db.trace, input)
+		ni, err := db.buildPlanned(pm, input, tsvs)
+		db.trace = db.trace[0 : len(db.trace)-1]
+		if err != nil {
+			return nil, err
+		}
+		n.OrderOnlys = append(n.OrderOnlys, ni)
+		ni.Parents = append(ni.Parents, n)
+	}
+
+	n.HasRule = true
+	n.Cmds = rule.cmds
+	n.ActualInputs = p.inputs
+	n.TargetSpecificVars = make(Vars)
+	for k, v := range tsvs {
+		n.TargetSpecificVars[k] = v
+	}
+	n.Filename = rule.filename
+	if len(rule.cmds) > 0 {
+		if rule.cmdLineno > 0 {
+			n.Lineno = rule.cmdLineno
+		} else {
+			n.Lineno = rule.lineno
+		}
+	}
+	return n, nil
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -38,14 +39,37 @@ type accessedMakefile struct {
 	State    fileState
 }
 
+// accessedFind is a find command and its output.
+type accessedFind struct {
+	Cmd    string
+	Output string
+}
+
+// accessedGlob is a glob pattern and the files matched.
+type accessedGlob struct {
+	Pattern string
+	Files   []string
+}
+
 type accessCache struct {
 	mu sync.Mutex
 	m  map[string]*accessedMakefile
+	// globs are the glob patterns and the files matched.
+	globs map[string][]string
+	// envs are the names of variables looked up in the environment,
+	// including undefined ones.
+	envs map[string]bool
+	// finds are the outputs of $(shell find) emulated with the find
+	// cache.
+	finds map[string]string
 }
 
 func newAccessCache() *accessCache {
 	return &accessCache{
-		m: make(map[string]*accessedMakefile),
+		m:     make(map[string]*accessedMakefile),
+		globs: make(map[string][]string),
+		envs:  make(map[string]bool),
+		finds: make(map[string]string),
 	}
 }
 
@@ -97,12 +121,97 @@ func (ac *accessCache) Slice() []*accessedMakefile {
 	return r
 }
 
+func (ac *accessCache) addGlob(pat string, files []string) {
+	if ac == nil {
+		return
+	}
+	ac.mu.Lock()
+	ac.globs[pat] = files
+	ac.mu.Unlock()
+}
+
+func (ac *accessCache) addEnv(name string) {
+	ac.mu.Lock()
+	ac.envs[name] = true
+	ac.mu.Unlock()
+}
+
+func (ac *accessCache) addFind(cmd, out string) {
+	if ac == nil {
+		return
+	}
+	ac.mu.Lock()
+	ac.finds[cmd] = out
+	ac.mu.Unlock()
+}
+
+// Globs returns the accessed globs sorted by patterns.
+func (ac *accessCache) Globs() []*accessedGlob {
+	if ac == nil {
+		return nil
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	var r []*accessedGlob
+	for pat, files := range ac.globs {
+		r = append(r, &accessedGlob{Pattern: pat, Files: files})
+	}
+	sort.Sort(byPattern(r))
+	return r
+}
+
+// Envs returns the sorted names of the accessed environment variables.
+func (ac *accessCache) Envs() []string {
+	if ac == nil {
+		return nil
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	var r []string
+	for name := range ac.envs {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Finds returns the emulated find commands and their outputs, sorted
+// by commands.
+func (ac *accessCache) Finds() []*accessedFind {
+	if ac == nil {
+		return nil
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	var r []*accessedFind
+	for cmd, out := range ac.finds {
+		r = append(r, &accessedFind{Cmd: cmd, Output: out})
+	}
+	sort.Sort(byCmd(r))
+	return r
+}
+
+type byPattern []*accessedGlob
+
+func (p byPattern) Len() int           { return len(p) }
+func (p byPattern) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPattern) Less(i, j int) bool { return p[i].Pattern < p[j].Pattern }
+
+type byCmd []*accessedFind
+
+func (p byCmd) Len() int           { return len(p) }
+func (p byCmd) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byCmd) Less(i, j int) bool { return p[i].Cmd < p[j].Cmd }
+
 type evalResult struct {
-	vars        Vars
-	rules       []*rule
-	ruleVars    map[string]Vars
-	accessedMks []*accessedMakefile
-	exports     map[string]bool
+	vars          Vars
+	rules         []*rule
+	ruleVars      map[string]Vars
+	accessedMks   []*accessedMakefile
+	accessedGlobs []*accessedGlob
+	accessedFinds []*accessedFind
+	usedEnvs      []string
+	exports       map[string]bool
 }
 
 type srcpos struct {
@@ -153,10 +262,16 @@ type Evaluator struct {
 	vars         Vars
 	lastRule     *rule
 	currentScope Vars
-	avoidIO      bool
-	hasIO        bool
-	cache        *accessCache
-	exports      map[string]bool
+	// recipeVars are the automatic and target specific variables
+	// of the recipe being expanded. They are never modified.
+	recipeVars Vars
+	// evalVars are the variables assigned by $(eval) in recipes,
+	// shared by the recipes of an execContext.
+	evalVars *recipeEvalVars
+	avoidIO  bool
+	hasIO    bool
+	cache    *accessCache
+	exports  map[string]bool
 
 	srcpos
 }
@@ -204,6 +319,7 @@ func (ev *Evaluator) evalAssign(ast *assignAST) error {
 		return ast.errorf("*** empty variable name.")
 	}
 	ev.outVars.Assign(lhs, rhs)
+	ev.evalVars.assign(lhs, rhs)
 	return nil
 }
 
@@ -378,7 +494,21 @@ func (ev *Evaluator) LookupVar(name string) Var {
 	if v.IsDefined() {
 		return v
 	}
-	return ev.vars.Lookup(name)
+	v = ev.evalVars.lookup(name)
+	if v.IsDefined() {
+		return v
+	}
+	if ev.recipeVars != nil {
+		v = ev.recipeVars.Lookup(name)
+		if v.IsDefined() {
+			return v
+		}
+	}
+	v = ev.vars.Lookup(name)
+	if ev.cache != nil && (!v.IsDefined() || v.Origin() == "environment") {
+		ev.cache.addEnv(name)
+	}
+	return v
 }
 
 func (ev *Evaluator) lookupVarInCurrentScope(name string) Var {
@@ -390,6 +520,16 @@ func (ev *Evaluator) lookupVarInCurrentScope(name string) Var {
 	if v.IsDefined() {
 		return v
 	}
+	v = ev.evalVars.lookup(name)
+	if v.IsDefined() {
+		return v
+	}
+	if ev.recipeVars != nil {
+		v = ev.recipeVars.Lookup(name)
+		if v.IsDefined() {
+			return v
+		}
+	}
 	return ev.vars.Lookup(name)
 }
 
@@ -453,12 +593,16 @@ func (ev *Evaluator) evalInclude(ast *includeAST) error {
 			if err != nil {
 				return ast.errorf("glob error: %s: %v", pat, err)
 			}
+			ev.cache.addGlob(pat, matched)
 			files = append(files, matched...)
 		} else {
 			files = append(files, pat)
 		}
 	}
 
+	if PrefetchIncludesFlag && len(files) > 1 {
+		makefileCache.prefetch(files)
+	}
 	for _, fn := range files {
 		fn = trimLeadingCurdir(fn)
 		if IgnoreOptionalInclude != "" && ast.op == "-include" && matchPattern(fn, IgnoreOptionalInclude) {
@@ -568,9 +712,11 @@ func (ev *Evaluator) eval(stmt ast) error {
 	return stmt.eval(ev)
 }
 
-func eval(mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
+// eval evaluates mk. If trackAccess is true, the makefiles, globs and
+// environment variables accessed are recorded in the result.
+func eval(mk makefile, vars Vars, trackAccess bool) (er *evalResult, err error) {
 	ev := NewEvaluator(vars)
-	if useCache {
+	if trackAccess {
 		ev.cache = newAccessCache()
 	}
 
@@ -592,10 +738,13 @@ func eval(mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
 	}
 
 	return &evalResult{
-		vars:        ev.outVars,
-		rules:       ev.outRules,
-		ruleVars:    ev.outRuleVars,
-		accessedMks: ev.cache.Slice(),
-		exports:     ev.exports,
+		vars:          ev.outVars,
+		rules:         ev.outRules,
+		ruleVars:      ev.outRuleVars,
+		accessedMks:   ev.cache.Slice(),
+		accessedGlobs: ev.cache.Globs(),
+		accessedFinds: ev.cache.Finds(),
+		usedEnvs:      ev.cache.Envs(),
+		exports:       ev.exports,
 	}, nil
 }
@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrefetchIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-time.Hour)
+	for i := 0; i < 20; i++ {
+		// Each makefile depends on the variables defined by the
+		// previous ones, so they must be evaluated in order.
+		mk := filepath.Join(dir, fmt.Sprintf("m%02d.mk", i))
+		err := ioutil.WriteFile(mk, []byte(fmt.Sprintf("X := $(X) %d\nY%d := $(words $(X))\n", i, i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(mk, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	makefile := filepath.Join(dir, "Makefile")
+	err = ioutil.WriteFile(makefile, []byte(fmt.Sprintf(`D := %s
+include $(sort $(wildcard $(D)/m*.mk))
+-include $(D)/missing.mk
+all:
+`, dir)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(f bool) { PrefetchIncludesFlag = f }(PrefetchIncludesFlag)
+	defer func(mc *makefileCacheT) { makefileCache = mc }(makefileCache)
+	var results [][]string
+	for _, prefetch := range []bool{false, true} {
+		PrefetchIncludesFlag = prefetch
+		// Start from an empty cache, so the makefiles are not
+		// parsed by the earlier pass.
+		makefileCache = newMakefileCache()
+		g, err := Load(LoadReq{Makefile: makefile})
+		if err != nil {
+			t.Fatalf("Load(prefetch=%t)=_, %v", prefetch, err)
+		}
+		want := 0
+		if prefetch {
+			// All but missing.mk, which is included alone.
+			want = 20
+		}
+		makefileCache.mu.Lock()
+		got := makefileCache.prefetched
+		makefileCache.mu.Unlock()
+		if got != want {
+			t.Errorf("prefetched(prefetch=%t)=%d; want=%d", prefetch, got, want)
+		}
+		var result []string
+		for _, name := range []string{"MAKEFILE_LIST", "X", "Y0", "Y19"} {
+			v, err := NewEvaluator(g.Vars()).EvaluateVar(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, v)
+		}
+		results = append(results, result)
+	}
+	for i, v := range results[1] {
+		if v != results[0][i] {
+			t.Errorf("prefetch: %q; want=%q", v, results[0][i])
+		}
+	}
+}
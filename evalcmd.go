@@ -15,19 +15,78 @@
 package kati
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
 	"sync"
+	"syscall"
 )
 
+// execContext expands recipes of DepNodes. It is safe to use from
+// multiple goroutines, as each expansion has its own Evaluator, the
+// global variables are never modified, and the variables assigned by
+// $(eval) in recipes are shared under a lock.
 type execContext struct {
-	shell string
+	shell   string
+	avoidIO bool
 
-	mu     sync.Mutex
-	ev     *Evaluator
-	output string
-	inputs []string
+	// ev is for the global variables, used only by the goroutine
+	// which owns the execContext.
+	ev *Evaluator
+
+	// evalVars are the variables assigned by $(eval) in recipes,
+	// which are visible to the recipes expanded later, as in GNU
+	// make.
+	evalVars *recipeEvalVars
+}
+
+// recipeEvalVars are variables assigned by $(eval) in recipes expanded
+// from multiple goroutines.
+type recipeEvalVars struct {
+	mu   sync.Mutex
+	vars Vars
+	// assigned counts the assignments.
+	assigned int
+}
+
+func newRecipeEvalVars() *recipeEvalVars {
+	return &recipeEvalVars{vars: make(Vars)}
+}
+
+func (rv *recipeEvalVars) lookup(name string) Var {
+	if rv == nil {
+		return undefinedVar{}
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return rv.vars.Lookup(name)
+}
+
+func (rv *recipeEvalVars) assign(name string, v Var) {
+	if rv == nil {
+		return
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.vars.Assign(name, v)
+	rv.assigned++
+}
+
+// count returns the number of the assignments so far.
+func (rv *recipeEvalVars) count() int {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return rv.assigned
+}
+
+// reset removes all the variables.
+func (rv *recipeEvalVars) reset() {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.vars = make(Vars)
+	rv.assigned = 0
 }
 
 func newExecContext(vars Vars, avoidIO bool) *execContext {
@@ -35,21 +94,9 @@ func newExecContext(vars Vars, avoidIO bool) *execContext {
 	ev.avoidIO = avoidIO
 
 	ctx := &execContext{
-		ev: ev,
-	}
-	av := autoVar{ctx: ctx}
-	for k, v := range map[string]Var{
-		"@": autoAtVar{autoVar: av},
-		"<": autoLessVar{autoVar: av},
-		"^": autoHatVar{autoVar: av},
-		"+": autoPlusVar{autoVar: av},
-		"*": autoStarVar{autoVar: av},
-	} {
-		ev.vars[k] = v
-		// $<k>D = $(patsubst %/,%,$(dir $<k>))
-		ev.vars[k+"D"] = suffixDVar(k)
-		// $<k>F = $(notdir $<k>)
-		ev.vars[k+"F"] = suffixFVar(k)
+		avoidIO:  avoidIO,
+		ev:       ev,
+		evalVars: newRecipeEvalVars(),
 	}
 
 	// TODO: We should move this to somewhere around evalCmd so that
@@ -62,10 +109,57 @@ func newExecContext(vars Vars, avoidIO bool) *execContext {
 	return ctx
 }
 
-func (ec *execContext) uniqueInputs() []string {
+// newEvaluator returns an Evaluator to expand the recipe of n. The
+// automatic variables and the target specific variables of n are in
+// its own scope on top of the global variables.
+func (ctx *execContext) newEvaluator(n *DepNode) *Evaluator {
+	ev := NewEvaluator(ctx.ev.vars)
+	ev.avoidIO = ctx.avoidIO
+	ev.cache = ctx.ev.cache
+	ev.evalVars = ctx.evalVars
+	ev.filename = n.Filename
+	ev.lineno = n.Lineno
+
+	scope := make(Vars, len(autoSuffixVars)+5+len(n.TargetSpecificVars))
+	for k, v := range autoSuffixVars {
+		scope[k] = v
+	}
+	av := autoVar{t: &autoVarTarget{output: n.Output, inputs: n.ActualInputs}}
+	scope["@"] = autoAtVar{autoVar: av}
+	scope["<"] = autoLessVar{autoVar: av}
+	scope["^"] = autoHatVar{autoVar: av}
+	scope["+"] = autoPlusVar{autoVar: av}
+	scope["*"] = autoStarVar{autoVar: av}
+	for k, v := range n.TargetSpecificVars {
+		scope[k] = v
+	}
+	ev.recipeVars = scope
+	return ev
+}
+
+// autoSuffixVars are $(@D), $(@F) and so on, which refer to the
+// automatic variables.
+var autoSuffixVars = func() Vars {
+	vars := make(Vars)
+	for _, k := range []string{"@", "<", "^", "+", "*"} {
+		// $<k>D = $(patsubst %/,%,$(dir $<k>))
+		vars[k+"D"] = suffixDVar(k)
+		// $<k>F = $(notdir $<k>)
+		vars[k+"F"] = suffixFVar(k)
+	}
+	return vars
+}()
+
+// autoVarTarget is the target of a recipe for automatic variables.
+type autoVarTarget struct {
+	output string
+	inputs []string
+}
+
+func (t *autoVarTarget) uniqueInputs() []string {
 	var uniqueInputs []string
 	seen := make(map[string]bool)
-	for _, input := range ec.inputs {
+	for _, input := range t.inputs {
 		if !seen[input] {
 			seen[input] = true
 			uniqueInputs = append(uniqueInputs, input)
@@ -74,7 +168,7 @@ func (ec *execContext) uniqueInputs() []string {
 	return uniqueInputs
 }
 
-type autoVar struct{ ctx *execContext }
+type autoVar struct{ t *autoVarTarget }
 
 func (v autoVar) Flavor() string  { return "undefined" }
 func (v autoVar) Origin() string  { return "automatic" }
@@ -98,7 +192,7 @@ func (v autoAtVar) Eval(w evalWriter, ev *Evaluator) error {
 	fmt.Fprint(w, v.String())
 	return nil
 }
-func (v autoAtVar) String() string { return v.ctx.output }
+func (v autoAtVar) String() string { return v.t.output }
 
 type autoLessVar struct{ autoVar }
 
@@ -107,8 +201,8 @@ func (v autoLessVar) Eval(w evalWriter, ev *Evaluator) error {
 	return nil
 }
 func (v autoLessVar) String() string {
-	if len(v.ctx.inputs) > 0 {
-		return v.ctx.inputs[0]
+	if len(v.t.inputs) > 0 {
+		return v.t.inputs[0]
 	}
 	return ""
 }
@@ -120,7 +214,7 @@ func (v autoHatVar) Eval(w evalWriter, ev *Evaluator) error {
 	return nil
 }
 func (v autoHatVar) String() string {
-	return strings.Join(v.ctx.uniqueInputs(), " ")
+	return strings.Join(v.t.uniqueInputs(), " ")
 }
 
 type autoPlusVar struct{ autoVar }
@@ -129,7 +223,7 @@ func (v autoPlusVar) Eval(w evalWriter, ev *Evaluator) error {
 	fmt.Fprint(w, v.String())
 	return nil
 }
-func (v autoPlusVar) String() string { return strings.Join(v.ctx.inputs, " ") }
+func (v autoPlusVar) String() string { return strings.Join(v.t.inputs, " ") }
 
 type autoStarVar struct{ autoVar }
 
@@ -139,7 +233,7 @@ func (v autoStarVar) Eval(w evalWriter, ev *Evaluator) error {
 }
 
 // TODO: Use currentStem. See auto_stem_var.mk
-func (v autoStarVar) String() string { return stripExt(v.ctx.output) }
+func (v autoStarVar) String() string { return stripExt(v.t.output) }
 
 func suffixDVar(k string) Var {
 	return &recursiveVar{
@@ -259,23 +353,35 @@ func (r runner) eval(ev *Evaluator, s string) ([]runner, error) {
 	return runners, nil
 }
 
-func (r runner) run(output string) error {
+// run runs the command. When ctx is done, the command and its
+// children are killed.
+func (r runner) run(ctx context.Context, output string, stdout, stderr io.Writer) error {
 	if r.echo || DryRunFlag {
-		fmt.Printf("%s\n", r.cmd)
+		fmt.Fprintf(stdout, "%s\n", r.cmd)
 	}
 	if DryRunFlag {
 		return nil
 	}
-	args := []string{r.shell, "-c", cmdline(r.cmd)}
-	cmd := exec.Cmd{
-		Path: args[0],
-		Args: args,
+	cmd := exec.CommandContext(ctx, r.shell, "-c", cmdline(r.cmd))
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if ctx.Done() != nil {
+		// Run in its own process group to kill all processes of
+		// the command on cancellation. Otherwise, the command
+		// stays in our group, so it gets signals from the
+		// terminal, e.g. SIGINT by Ctrl-C.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
-	out, err := cmd.CombinedOutput()
-	fmt.Printf("%s", out)
 	exit := exitStatus(err)
 	if r.ignoreError && exit != 0 {
-		fmt.Printf("[%s] Error %d (ignored)\n", output, exit)
+		fmt.Fprintf(stdout, "[%s] Error %d (ignored)\n", output, exit)
 		err = nil
 	}
 	return err
@@ -287,20 +393,7 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 		return runners, false, nil
 	}
 
-	ctx.mu.Lock()
-	defer ctx.mu.Unlock()
-	// For automatic variables.
-	ctx.output = n.Output
-	ctx.inputs = n.ActualInputs
-	for k, v := range n.TargetSpecificVars {
-		restore := ctx.ev.vars.save(k)
-		defer restore()
-		ctx.ev.vars[k] = v
-		logf("set tsv: %s=%s", k, v)
-	}
-
-	ctx.ev.filename = n.Filename
-	ctx.ev.lineno = n.Lineno
+	ev := ctx.newEvaluator(n)
 	logf("Building: %s cmds:%q", n.Output, n.Cmds)
 	r := runner{
 		output: n.Output,
@@ -308,7 +401,7 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 		shell:  ctx.shell,
 	}
 	for _, cmd := range n.Cmds {
-		rr, err := r.eval(ctx.ev, cmd)
+		rr, err := r.eval(ev, cmd)
 		if err != nil {
 			return nil, false, err
 		}
@@ -318,7 +411,23 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 			}
 		}
 	}
-	return runners, ctx.ev.hasIO, nil
+	return runners, ev.hasIO, nil
+}
+
+// evalTargetSpecificVar evaluates the target specific variable name of
+// n, e.g. .KATI_TIMEOUT. It reports false if n does not have it.
+func evalTargetSpecificVar(ctx *execContext, n *DepNode, name string) (string, bool, error) {
+	v, ok := n.TargetSpecificVars[name]
+	if !ok {
+		return "", false, nil
+	}
+	var buf evalBuffer
+	buf.resetSep()
+	err := v.Eval(&buf, ctx.newEvaluator(n))
+	if err != nil {
+		return "", true, err
+	}
+	return strings.TrimSpace(buf.String()), true, nil
 }
 
 func evalCommands(nodes []*DepNode, vars Vars) error {
@@ -338,7 +447,14 @@ func evalCommands(nodes []*DepNode, vars Vars) error {
 		}
 
 		n.Cmds = []string{}
-		n.TargetSpecificVars = make(Vars)
+		// Keep variables for kati, which are not for commands.
+		tsvs := make(Vars)
+		for k, v := range n.TargetSpecificVars {
+			if strings.HasPrefix(k, ".KATI_") {
+				tsvs[k] = v
+			}
+		}
+		n.TargetSpecificVars = tsvs
 		for _, r := range runners {
 			n.Cmds = append(n.Cmds, r.String())
 		}
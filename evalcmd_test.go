@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCreateRunnersConcurrently(t *testing.T) {
+	vars := make(Vars)
+	vars.Assign("CC", &simpleVar{value: "cc", origin: "file"})
+	ctx := newExecContext(vars, false)
+
+	var nodes []*DepNode
+	var want [][]runner
+	for i := 0; i < 100; i++ {
+		output := fmt.Sprintf("out/%d.o", i)
+		input := fmt.Sprintf("src/%d.c", i)
+		n := &DepNode{
+			Output:             output,
+			Cmds:               []string{"@mkdir -p $(@D)", "$(CC) $(FLAGS) -c $< -o $@"},
+			ActualInputs:       []string{input},
+			TargetSpecificVars: make(Vars),
+		}
+		flags := ""
+		if i%2 == 0 {
+			flags = fmt.Sprintf("-DN=%d", i)
+			n.TargetSpecificVars.Assign("FLAGS", &targetSpecificVar{
+				v:  &simpleVar{value: flags, origin: "file"},
+				op: ":=",
+			})
+		}
+		nodes = append(nodes, n)
+		want = append(want, []runner{
+			{output: output, cmd: "mkdir -p out", shell: ctx.shell},
+			{output: output, cmd: fmt.Sprintf("cc %s -c %s -o %s", flags, input, output), echo: true, shell: ctx.shell},
+		})
+	}
+
+	got := make([][]runner, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n *DepNode) {
+			defer wg.Done()
+			rr, _, err := createRunners(ctx, n)
+			if err != nil {
+				t.Errorf("createRunners(%s)=_, _, %v", n.Output, err)
+			}
+			got[i] = rr
+		}(i, n)
+	}
+	wg.Wait()
+	for i := range nodes {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("createRunners(%s)=%q; want=%q", nodes[i].Output, got[i], want[i])
+		}
+	}
+	if _, ok := vars["@"]; ok {
+		t.Errorf("createRunners modified the global variables")
+	}
+}
+
+func TestExistsInVPATHTargetSpecific(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evalcmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	err = os.Mkdir(src, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(src, "gen"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newExecContext(make(Vars), false)
+	n := &DepNode{Output: "gen", TargetSpecificVars: make(Vars)}
+	if got, ok := existsInVPATH(ctx.newEvaluator(n), "gen"); ok {
+		t.Errorf("existsInVPATH(gen)=%q, %t; want=%q, false", got, ok, "gen")
+	}
+	n.TargetSpecificVars.Assign("VPATH", &targetSpecificVar{
+		v:  &simpleVar{value: src, origin: "file"},
+		op: ":=",
+	})
+	want := filepath.Join(src, "gen")
+	if got, ok := existsInVPATH(ctx.newEvaluator(n), "gen"); got != want || !ok {
+		t.Errorf("existsInVPATH(gen) with VPATH=%s=%q, %t; want=%q, true", src, got, ok, want)
+	}
+}
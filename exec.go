@@ -15,8 +15,10 @@
 package kati
 
 import (
-	"fmt"
+	"context"
+	"io"
 	"os"
+	"sort"
 	"time"
 )
 
@@ -33,6 +35,34 @@ type Executor struct {
 
 	ctx *execContext
 
+	// buildCtx is the context of the running build.
+	buildCtx context.Context
+	stdout   io.Writer
+	stderr   io.Writer
+	observer Observer
+
+	recipeTimeout time.Duration
+	stallWarning  time.Duration
+
+	outputSync string
+	status     *buildStatus
+	metrics    *buildMetrics
+	metricsOut string
+
+	pools     map[string]*jobPool
+	poolDepth map[string]int
+
+	// timings and cp are set for critical path scheduling.
+	timings *timingLog
+	cp      *criticalPath
+
+	hashState   *hashState
+	actionCache outputCache
+	// actionEnv is the sorted exported variables, which are part of
+	// the keys of actionCache.
+	actionEnv []string
+	ccWrapper *ccWrapper
+
 	trace          []string
 	buildCnt       int
 	alreadyDoneCnt int
@@ -42,7 +72,7 @@ type Executor struct {
 }
 
 func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
-	output, _ := existsInVPATH(ex.ctx.ev, n.Output)
+	output, _ := existsInVPATH(ex.ctx.newEvaluator(n), n.Output)
 	if neededBy != nil {
 		logf("MakeJob: %s for %s", output, neededBy.n.Output)
 	}
@@ -56,9 +86,7 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 
 	if present {
 		if j == nil {
-			if !n.IsPhony {
-				fmt.Printf("Circular %s <- %s dependency dropped.\n", neededBy.n.Output, n.Output)
-			}
+			// The cycle was reported by depBuilder.
 			if neededBy != nil {
 				neededBy.numDeps--
 			}
@@ -80,6 +108,17 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 	if neededBy != nil {
 		j.parents = append(j.parents, neededBy)
 	}
+	if ex.cp != nil {
+		j.priority = ex.cp.priority(n)
+	}
+	if ex.status != nil && n.HasRule && len(n.Cmds) > 0 {
+		ex.status.addJob()
+	}
+	pool, err := nodePool(ex.ctx, n, ex.poolDepth)
+	if err != nil {
+		return err
+	}
+	j.pool = ex.pools[pool]
 
 	ex.done[output] = nil
 	// We iterate n.Deps twice. In the first run, we may modify
@@ -90,8 +129,7 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 		deps = append(deps, d)
 	}
 	for _, d := range n.OrderOnlys {
-		// need lock for ex.ctx.ev?
-		if _, ok := existsInVPATH(ex.ctx.ev, d.Output); ok {
+		if _, ok := existsInVPATH(ex.ctx.newEvaluator(d), d.Output); ok {
 			j.numDeps--
 			continue
 		}
@@ -127,6 +165,90 @@ func (ex *Executor) reportStats() {
 // ExecutorOpt is an option for Executor.
 type ExecutorOpt struct {
 	NumJobs int
+
+	// Stdout and Stderr are where the output of recipes and kati's
+	// messages go. If nil, os.Stdout and os.Stderr are used.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Observer, if set, receives the progress of jobs.
+	Observer Observer
+
+	// RecipeTimeout is the limit of the time to run the recipe of
+	// a target. The commands are killed over the limit. A target
+	// specific variable .KATI_TIMEOUT overrides it in seconds.
+	// Zero means no limit.
+	RecipeTimeout time.Duration
+
+	// StallWarning, if not zero, warns about jobs which have
+	// produced no output for the duration.
+	StallWarning time.Duration
+
+	// ShowStatus shows ninja-style status lines for running jobs.
+	// The format of the status can be given by KATI_STATUS, which
+	// works as NINJA_STATUS.
+	ShowStatus bool
+
+	// BuildMetrics is a JSON file to write the summary of the
+	// build: the total time, durations of targets, the counts of
+	// built and up-to-date targets, and the critical path.
+	BuildMetrics string
+
+	// MaxLoad is like GNU make's -l. No new jobs are started while
+	// other jobs are running and the load average is at least
+	// MaxLoad. Zero means no limit.
+	MaxLoad float64
+
+	// MaxMem is the limit of the memory in use on the machine, in
+	// bytes. No new jobs are started while other jobs are running
+	// and the memory in use is at least MaxMem. Zero means no limit.
+	MaxMem int64
+
+	// OutputSync is the output synchronization mode of recipes,
+	// one of OutputSyncNone, OutputSyncLine, OutputSyncTarget and
+	// OutputSyncRecurse. If empty, OutputSyncNone is used for a
+	// single job, and OutputSyncTarget for parallel jobs.
+	OutputSync string
+
+	// CriticalPathLog is a file to keep durations of recipes. If
+	// set, ready jobs are started in order of the expected length
+	// of their longest downstream path instead of first come,
+	// first serve.
+	CriticalPathLog string
+
+	// ContentHashState is a file to keep content digests of inputs
+	// and outputs of targets. If set, recipes whose inputs have the
+	// same contents as the last build are skipped even if they are
+	// newer than the output, and a rebuilt output with the same
+	// contents does not make its parents stale.
+	ContentHashState string
+
+	// ActionCache is a directory to cache outputs of targets
+	// listed in .KATI_CACHEABLE. The outputs are restored from the
+	// cache instead of running the recipes when the commands, the
+	// environment and the contents of the inputs are the same.
+	ActionCache string
+
+	// ActionCacheSize is the limit of the action cache in bytes.
+	// The least recently used entries are evicted over the limit.
+	// Zero means no limit.
+	ActionCacheSize int64
+
+	// RemoteCache is the URL of an HTTP cache server which speaks
+	// the protocol of the Bazel HTTP cache, e.g. bazel-remote. It is
+	// consulted for targets listed in .KATI_CACHEABLE, after
+	// ActionCache if set.
+	RemoteCache string
+
+	// RemoteCacheTimeout is the timeout of connecting to RemoteCache
+	// and waiting for its responses. Transfers of bodies are not
+	// limited. If the server is unreachable, recipes run locally.
+	RemoteCacheTimeout time.Duration
+
+	// CCWrapper is a compiler launcher, e.g. ccache, prepended to
+	// the commands matched by CCRegexp, as NinjaOpt.CCWrapper.
+	CCWrapper string
+	CCRegexp  string
 }
 
 // NewExecutor creates new Executor.
@@ -137,7 +259,22 @@ func NewExecutor(opt *ExecutorOpt) (*Executor, error) {
 	if opt.NumJobs < 1 {
 		opt.NumJobs = 1
 	}
-	wm, err := newWorkerManager(opt.NumJobs)
+	outputSync := opt.OutputSync
+	if outputSync == "" {
+		outputSync = OutputSyncNone
+		if opt.NumJobs > 1 {
+			outputSync = OutputSyncTarget
+		}
+	}
+	err := checkOutputSync(outputSync)
+	if err != nil {
+		return nil, err
+	}
+	ccw, err := newCCWrapper(opt.CCWrapper, opt.CCRegexp)
+	if err != nil {
+		return nil, err
+	}
+	wm, err := newWorkerManager(opt)
 	if err != nil {
 		return nil, err
 	}
@@ -146,35 +283,148 @@ func NewExecutor(opt *ExecutorOpt) (*Executor, error) {
 		suffixRules: make(map[string][]*rule),
 		done:        make(map[string]*job),
 		wm:          wm,
+		stdout:      opt.Stdout,
+		stderr:      opt.Stderr,
+		observer:    opt.Observer,
+		outputSync:  outputSync,
+		metrics:     newBuildMetrics(),
+		metricsOut:  opt.BuildMetrics,
+		ccWrapper:   ccw,
+	}
+	ex.recipeTimeout = opt.RecipeTimeout
+	ex.stallWarning = opt.StallWarning
+	if ex.stdout == nil {
+		ex.stdout = os.Stdout
+	}
+	if ex.stderr == nil {
+		ex.stderr = os.Stderr
+	}
+	if opt.ShowStatus {
+		ex.status = newBuildStatus(ex.stdout)
+	}
+	if opt.CriticalPathLog != "" {
+		ex.timings, err = loadTimingLog(opt.CriticalPathLog)
+		if err != nil {
+			return nil, err
+		}
+		ex.cp = newCriticalPath(ex.timings)
+	}
+	if opt.ContentHashState != "" {
+		ex.hashState, err = loadHashState(opt.ContentHashState)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var caches tieredCache
+	if opt.ActionCache != "" {
+		ac, err := newActionCache(opt.ActionCache, opt.ActionCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		caches = append(caches, ac)
+	}
+	if opt.RemoteCache != "" {
+		caches = append(caches, newRemoteCache(opt.RemoteCache, opt.RemoteCacheTimeout, ex.stderr))
+	}
+	switch len(caches) {
+	case 0:
+	case 1:
+		ex.actionCache = caches[0]
+	default:
+		ex.actionCache = caches
 	}
 	return ex, nil
 }
 
 // Exec executes to build roots.
 func (ex *Executor) Exec(g *DepGraph) error {
+	_, err := ex.ExecContext(context.Background(), g)
+	return err
+}
+
+// ExecContext executes to build roots. When ctx is done, no new jobs
+// are started and running commands are killed. The returned
+// BuildResult has the targets processed so far, even on error.
+func (ex *Executor) ExecContext(ctx context.Context, g *DepGraph) (*BuildResult, error) {
+	ex.buildCtx = ctx
 	ex.ctx = newExecContext(g.vars, false)
+	g.reportCycles(ex.stderr)
+
+	// fail stops the workers, which are waiting for jobs.
+	fail := func(err error) (*BuildResult, error) {
+		ex.wm.Cancel(err)
+		ex.wm.Wait()
+		return ex.metrics.result(), err
+	}
 
 	// TODO: Handle target specific variables.
+	ex.actionEnv = nil
 	for name, export := range g.exports {
 		if export {
 			v, err := ex.ctx.ev.EvaluateVar(name)
 			if err != nil {
-				return err
+				return fail(err)
 			}
 			os.Setenv(name, v)
+			ex.actionEnv = append(ex.actionEnv, name+"="+v)
 		} else {
 			os.Unsetenv(name)
 		}
 	}
+	sort.Strings(ex.actionEnv)
+
+	var err error
+	ex.poolDepth, err = declaredPools(ex.ctx.ev, g.vars)
+	if err != nil {
+		return fail(err)
+	}
+	ex.pools = make(map[string]*jobPool)
+	for name, depth := range ex.poolDepth {
+		ex.pools[name] = &jobPool{depth: depth}
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ex.wm.Cancel(ctx.Err())
+		case <-stop:
+		}
+	}()
 
 	startTime := time.Now()
 	for _, root := range g.nodes {
-		err := ex.makeJobs(root, nil)
+		err = ex.makeJobs(root, nil)
 		if err != nil {
+			// Stop running jobs if the worker manager is
+			// still running.
+			ex.wm.Cancel(err)
 			break
 		}
 	}
-	err := ex.wm.Wait()
+	err = ex.wm.Wait()
+	if ex.status != nil {
+		ex.status.done()
+	}
 	logStats("exec time: %q", time.Since(startTime))
-	return err
+	if ex.timings != nil {
+		serr := ex.timings.save()
+		if err == nil {
+			err = serr
+		}
+	}
+	if ex.hashState != nil {
+		herr := ex.hashState.save()
+		if err == nil {
+			err = herr
+		}
+	}
+	if ex.metricsOut != "" {
+		merr := ex.metrics.write(ex.metricsOut)
+		if err == nil {
+			err = merr
+		}
+	}
+	return ex.metrics.result(), err
 }
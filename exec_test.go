@@ -0,0 +1,429 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu      sync.Mutex
+	events  []string
+	output  bytes.Buffer
+	started chan string
+}
+
+func (o *recordingObserver) record(f string, a ...interface{}) {
+	o.mu.Lock()
+	o.events = append(o.events, fmt.Sprintf(f, a...))
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) JobStarted(target string) {
+	o.record("started %s", filepath.Base(target))
+	if o.started != nil {
+		o.started <- target
+	}
+}
+
+func (o *recordingObserver) JobOutput(target string, isStderr bool, b []byte) {
+	o.mu.Lock()
+	o.output.Write(b)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) JobFinished(target string, d time.Duration, exit int) {
+	o.record("finished %s %d", filepath.Base(target), exit)
+}
+
+func (o *recordingObserver) JobSkipped(target string) {
+	o.record("skipped %s", filepath.Base(target))
+}
+
+func loadTestMakefile(t *testing.T, dir, mk string, targets ...string) *DepGraph {
+	makefile := filepath.Join(dir, "Makefile")
+	err := ioutil.WriteFile(makefile, []byte(fmt.Sprintf("D := %s\n%s", dir, mk)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: makefile, Targets: targets})
+	if err != nil {
+		t.Fatalf("Load(%q)=_, %v", makefile, err)
+	}
+	return g
+}
+
+func TestExecContextObserver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "a"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := loadTestMakefile(t, dir, `
+$(D)/c: $(D)/b
+	echo c; touch $@
+$(D)/b: $(D)/a
+	echo b; exit 3
+`)
+	var stdout bytes.Buffer
+	o := &recordingObserver{}
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, Stdout: &stdout, Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ex.ExecContext(context.Background(), g)
+	if err == nil {
+		t.Errorf("ExecContext()=_, <nil>; want error")
+	}
+	if want := []string{"started b", "finished b 3"}; !reflect.DeepEqual(o.events, want) {
+		t.Errorf("events=%q; want=%q", o.events, want)
+	}
+	if got, want := o.output.String(), "echo b; exit 3\nb\n"; got != want {
+		t.Errorf("observed output=%q; want=%q", got, want)
+	}
+	if got, want := stdout.String(), o.output.String(); got != want {
+		t.Errorf("stdout=%q; want=%q", got, want)
+	}
+	if len(r.Targets) != 1 || r.Targets[0].Status != TargetFailed || r.Targets[0].Exit != 3 {
+		t.Errorf("Targets=%v; want failed b with exit 3", r.Targets)
+	}
+
+	// b is up to date now.
+	err = ioutil.WriteFile(filepath.Join(dir, "b"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o = &recordingObserver{}
+	ex, err = NewExecutor(&ExecutorOpt{NumJobs: 1, Stdout: &stdout, Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = ex.ExecContext(context.Background(), g)
+	if err != nil {
+		t.Errorf("ExecContext()=_, %v; want <nil>", err)
+	}
+	if want := []string{"skipped b", "started c", "finished c 0"}; !reflect.DeepEqual(o.events, want) {
+		t.Errorf("events=%q; want=%q", o.events, want)
+	}
+	var statuses []TargetStatus
+	for _, tr := range r.Targets {
+		statuses = append(statuses, tr.Status)
+	}
+	if want := []TargetStatus{TargetUpToDate, TargetBuilt}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses=%q; want=%q", statuses, want)
+	}
+}
+
+func TestExecContextObserverCreateRunnersError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := loadTestMakefile(t, dir, `
+$(D)/bad:
+	$(error bad recipe)
+`)
+	o := &recordingObserver{}
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, Stdout: ioutil.Discard, Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ex.ExecContext(context.Background(), g)
+	if err == nil {
+		t.Errorf("ExecContext()=_, <nil>; want error")
+	}
+	if want := []string{"started bad", "finished bad 0"}; !reflect.DeepEqual(o.events, want) {
+		t.Errorf("events=%q; want=%q", o.events, want)
+	}
+}
+
+func TestExecContextCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := loadTestMakefile(t, dir, `
+$(D)/all: $(D)/slow
+	touch $@
+$(D)/slow:
+	@sleep 10 & sleep 10; touch $@
+`)
+	o := &recordingObserver{started: make(chan string, 1)}
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, Stdout: ioutil.Discard, Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-o.started
+		cancel()
+	}()
+	startTime := time.Now()
+	_, err = ex.ExecContext(ctx, g)
+	if err == nil {
+		t.Errorf("ExecContext()=_, <nil>; want error")
+	}
+	if d := time.Since(startTime); d > 5*time.Second {
+		t.Errorf("ExecContext took %v after cancel", d)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "all")); err == nil {
+		t.Errorf("all is built after cancel")
+	}
+}
+
+// TestExecContextSetupError checks ExecContext returns a result even
+// when it fails before starting jobs.
+func TestExecContextSetupError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := loadTestMakefile(t, dir, `
+.KATI_POOL.link := 0
+$(D)/all:
+	touch $@
+`)
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, Stdout: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ex.ExecContext(context.Background(), g)
+	if err == nil {
+		t.Errorf("ExecContext()=_, <nil>; want error")
+	}
+	if r == nil || len(r.Targets) != 0 {
+		t.Errorf("ExecContext()=%v, _; want an empty result", r)
+	}
+}
+
+// TestExecProcessGroup checks recipes are in their own process groups
+// only when the build can be cancelled, so Ctrl-C reaches them
+// otherwise.
+func TestExecProcessGroup(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, tc := range []struct {
+		ctx       context.Context
+		sameGroup bool
+	}{
+		{ctx: context.Background(), sameGroup: true},
+		{ctx: ctx, sameGroup: false},
+	} {
+		dir, err := ioutil.TempDir("", "exec")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		// The 5th field of stat is the process group.
+		g := loadTestMakefile(t, dir, `
+$(D)/pgrp:
+	@cut -d' ' -f5 /proc/$$$$/stat > $@
+`)
+		ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, Stdout: ioutil.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ex.ExecContext(tc.ctx, g)
+		if err != nil {
+			t.Fatalf("ExecContext()=_, %v", err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, "pgrp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.TrimSpace(string(b)) == strconv.Itoa(syscall.Getpgrp())
+		if got != tc.sameGroup {
+			t.Errorf("recipe in the process group of kati=%t with %v; want=%t", got, tc.ctx, tc.sameGroup)
+		}
+	}
+}
+
+func TestRecipeTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := loadTestMakefile(t, dir, `
+$(D)/slow: .KATI_TIMEOUT := 0.2
+$(D)/slow:
+	@sleep 10
+`)
+	var stderr bytes.Buffer
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, Stdout: ioutil.Discard, Stderr: &stderr, StallWarning: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := time.Now()
+	_, err = ex.ExecContext(context.Background(), g)
+	want := fmt.Sprintf("[%s] timed out after 0.2 s", filepath.Join(dir, "slow"))
+	if err == nil || err.Error() != want {
+		t.Errorf("ExecContext()=_, %v; want=%q", err, want)
+	}
+	if d := time.Since(startTime); d > 5*time.Second {
+		t.Errorf("ExecContext took %v", d)
+	}
+	if !bytes.Contains(stderr.Bytes(), []byte("has produced no output")) {
+		t.Errorf("stderr=%q; want a stall warning", stderr.String())
+	}
+}
+
+type concurrencyObserver struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (o *concurrencyObserver) JobStarted(target string) {
+	o.mu.Lock()
+	o.running++
+	if o.running > o.max {
+		o.max = o.running
+	}
+	o.mu.Unlock()
+}
+
+func (o *concurrencyObserver) JobOutput(target string, isStderr bool, b []byte) {}
+
+func (o *concurrencyObserver) JobFinished(target string, d time.Duration, exit int) {
+	o.mu.Lock()
+	o.running--
+	o.mu.Unlock()
+}
+
+func (o *concurrencyObserver) JobSkipped(target string) {}
+
+func TestDeclaredPools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tc := range []struct {
+		mk   string
+		want map[string]int
+		err  string
+	}{
+		{
+			mk:   ".KATI_POOL.link := 2\n.KATI_POOL.cc := 8\n",
+			want: map[string]int{"link": 2, "cc": 8},
+		},
+		{
+			mk:  ".KATI_POOL.link := 0\n",
+			err: `invalid depth of pool "link": "0"`,
+		},
+		{
+			mk:  ".KATI_POOL.console := 1\n",
+			err: `.KATI_POOL.console: pool "console" is reserved`,
+		},
+		{
+			mk:  ".KATI_POOL.local_pool := 4\n",
+			err: `.KATI_POOL.local_pool: pool "local_pool" is reserved`,
+		},
+	} {
+		g := loadTestMakefile(t, dir, tc.mk+"all:\n")
+		pools, err := declaredPools(NewEvaluator(g.vars), g.vars)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("declaredPools(%q)=_, %v; want=%q", tc.mk, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(pools, tc.want) {
+			t.Errorf("declaredPools(%q)=%v, %v; want=%v", tc.mk, pools, err, tc.want)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := loadTestMakefile(t, dir, `
+.KATI_POOL.link := 2
+all: $(D)/a $(D)/b $(D)/c $(D)/d
+.PHONY: all $(D)/a $(D)/b $(D)/c $(D)/d
+$(D)/a $(D)/b $(D)/c $(D)/d: .KATI_POOL := link
+$(D)/a $(D)/b $(D)/c $(D)/d:
+	@sleep 0.1
+`, "all")
+	o := &concurrencyObserver{}
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 4, Stdout: ioutil.Discard, Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ex.ExecContext(context.Background(), g)
+	if err != nil {
+		t.Errorf("ExecContext()=_, %v", err)
+	}
+	if o.max > 2 {
+		t.Errorf("max running jobs in pool link=%d; want<=2", o.max)
+	}
+}
+
+func TestRecipeEvalAssign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, numJobs := range []int{1, 4} {
+		// $(eval) in a recipe is visible to the later recipes.
+		g := loadTestMakefile(t, dir, `
+all: b
+b: a
+	@echo FOO=$(FOO)
+a:
+	@echo a $(eval FOO := bar)
+.PHONY: all a b
+`, "all")
+		var stdout bytes.Buffer
+		ex, err := NewExecutor(&ExecutorOpt{NumJobs: numJobs, Stdout: &stdout})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ex.ExecContext(context.Background(), g)
+		if err != nil {
+			t.Errorf("ExecContext(-j %d)=_, %v", numJobs, err)
+		}
+		if want := "a\nFOO=bar\n"; stdout.String() != want {
+			t.Errorf("ExecContext(-j %d) output=%q; want=%q", numJobs, stdout.String(), want)
+		}
+	}
+}
@@ -32,8 +32,9 @@ func existsInVPATH(ev *Evaluator, target string) (string, bool) {
 	if exists(target) {
 		return target, true
 	}
-	vpath, found := ev.vars["VPATH"]
-	if !found {
+	// VPATH may be a target specific variable of a recipe.
+	vpath := ev.LookupVar("VPATH")
+	if !vpath.IsDefined() {
 		return target, false
 	}
 	// TODO(ukai): support vpath directive (pattern vpath).
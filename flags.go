@@ -28,4 +28,11 @@ var (
 	UseShellBuiltins bool
 
 	IgnoreOptionalInclude string
+
+	// PrefetchIncludesFlag parses included makefiles in background
+	// ahead of evaluation.
+	PrefetchIncludesFlag bool
+
+	// WerrorCyclesFlag makes circular dependencies errors.
+	WerrorCyclesFlag bool
 )
@@ -584,10 +584,11 @@ func (f *funcWildcard) Eval(w evalWriter, ev *Evaluator) error {
 	t := time.Now()
 	for _, word := range wb.words {
 		pat := string(word)
-		err = wildcard(w, pat)
+		files, err := wildcard(w, pat)
 		if err != nil {
 			return err
 		}
+		ev.cache.addGlob(pat, files)
 	}
 	wb.release()
 	traceEvent.end(te)
@@ -1265,6 +1266,7 @@ func (f *funcEvalAssign) Eval(w evalWriter, ev *Evaluator) error {
 		logf("Eval ASSIGN: %s=%q (flavor:%q)", f.lhs, rvalue, rvalue.Flavor())
 	}
 	ev.outVars.Assign(f.lhs, rvalue)
+	ev.evalVars.assign(f.lhs, rvalue)
 	return nil
 }
 
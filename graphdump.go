@@ -0,0 +1,205 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// GraphDumpOpt is an option for DumpGraph.
+type GraphDumpOpt struct {
+	// Format is "dot" or "json".
+	Format string
+	// Roots are the targets to start from. If empty, the goals are
+	// used.
+	Roots []string
+	// Depth limits the distance of the dumped nodes from the roots.
+	// Zero means no limit.
+	Depth int
+}
+
+// graphDumpNode is a node of the JSON dump.
+type graphDumpNode struct {
+	// Target is the name of the target, which identifies the node.
+	Target string `json:"target"`
+	// Location is the filename and the line number of the recipe,
+	// e.g. "Makefile:3", or only the filename if the rule has no
+	// recipe. It is empty if the target has no rule.
+	Location string   `json:"location,omitempty"`
+	Phony    bool     `json:"phony,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	// Truncated is set if the prerequisites of the target are not
+	// dumped because of the depth limit.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// graphDumpEdge is an edge of the JSON dump, from a target to its
+// prerequisite.
+type graphDumpEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	OrderOnly bool   `json:"order_only,omitempty"`
+}
+
+// graphDump is the JSON dump of a dependency graph:
+//
+//	{
+//	  "nodes": [{"target": "all", "location": "Makefile:1", "phony": true}, ...],
+//	  "edges": [{"from": "all", "to": "foo.o"}, ...]
+//	}
+//
+// Nodes are listed in breadth first order from the roots, and edges in
+// the order of the prerequisites of each node.
+type graphDump struct {
+	Nodes []graphDumpNode `json:"nodes"`
+	Edges []graphDumpEdge `json:"edges"`
+}
+
+// DumpGraph writes g in the format of opt to w.
+func DumpGraph(w io.Writer, g *DepGraph, opt GraphDumpOpt) error {
+	d, err := newGraphDump(g, opt)
+	if err != nil {
+		return err
+	}
+	switch opt.Format {
+	case "dot":
+		d.writeDot(w)
+		return nil
+	case "json":
+		b, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	return fmt.Errorf("unknown graph format: %q", opt.Format)
+}
+
+func newGraphDump(g *DepGraph, opt GraphDumpOpt) (*graphDump, error) {
+	roots := g.nodes
+	if len(opt.Roots) > 0 {
+		all := make(map[string]*DepNode)
+		var collect func(n *DepNode)
+		collect = func(n *DepNode) {
+			if _, ok := all[n.Output]; ok {
+				return
+			}
+			all[n.Output] = n
+			for _, d := range n.Deps {
+				collect(d)
+			}
+			for _, d := range n.OrderOnlys {
+				collect(d)
+			}
+		}
+		for _, n := range g.nodes {
+			collect(n)
+		}
+		roots = nil
+		for _, r := range opt.Roots {
+			n, ok := all[r]
+			if !ok {
+				return nil, fmt.Errorf("unknown target: %q", r)
+			}
+			roots = append(roots, n)
+		}
+	}
+
+	d := &graphDump{Nodes: []graphDumpNode{}, Edges: []graphDumpEdge{}}
+	depth := make(map[string]int)
+	var queue []*DepNode
+	for _, n := range roots {
+		if _, ok := depth[n.Output]; !ok {
+			depth[n.Output] = 0
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		dn := graphDumpNode{
+			Target:   n.Output,
+			Phony:    n.IsPhony,
+			Commands: n.Cmds,
+		}
+		dn.Location = n.Filename
+		if n.Filename != "" && n.Lineno > 0 {
+			dn.Location = fmt.Sprintf("%s:%d", n.Filename, n.Lineno)
+		}
+		truncated := opt.Depth > 0 && depth[n.Output] >= opt.Depth
+		dn.Truncated = truncated && len(n.Deps)+len(n.OrderOnlys) > 0
+		d.Nodes = append(d.Nodes, dn)
+		if truncated {
+			continue
+		}
+		add := func(c *DepNode, orderOnly bool) {
+			d.Edges = append(d.Edges, graphDumpEdge{From: n.Output, To: c.Output, OrderOnly: orderOnly})
+			if _, ok := depth[c.Output]; !ok {
+				depth[c.Output] = depth[n.Output] + 1
+				queue = append(queue, c)
+			}
+		}
+		for _, c := range n.Deps {
+			add(c, false)
+		}
+		for _, c := range n.OrderOnlys {
+			add(c, true)
+		}
+	}
+	return d, nil
+}
+
+// dotQuote quotes s as a DOT ID.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + strings.Replace(s, "\n", `\n`, -1) + `"`
+}
+
+// writeDot writes d as a Graphviz graph. Phony targets are gray
+// ellipses, and order-only prerequisites are dashed edges.
+func (d *graphDump) writeDot(w io.Writer) {
+	fmt.Fprintf(w, "digraph kati {\n")
+	fmt.Fprintf(w, "  node [shape=box];\n")
+	for _, n := range d.Nodes {
+		var attrs []string
+		if n.Phony {
+			attrs = append(attrs, "shape=ellipse", "style=filled", "fillcolor=lightgray")
+		}
+		if n.Truncated {
+			attrs = append(attrs, "peripheries=2")
+		}
+		if n.Location != "" {
+			attrs = append(attrs, "tooltip="+dotQuote(n.Location))
+		}
+		fmt.Fprintf(w, "  %s", dotQuote(n.Target))
+		if len(attrs) > 0 {
+			fmt.Fprintf(w, " [%s]", strings.Join(attrs, ", "))
+		}
+		fmt.Fprintf(w, ";\n")
+	}
+	for _, e := range d.Edges {
+		fmt.Fprintf(w, "  %s -> %s", dotQuote(e.From), dotQuote(e.To))
+		if e.OrderOnly {
+			fmt.Fprintf(w, " [style=dashed]")
+		}
+		fmt.Fprintf(w, ";\n")
+	}
+	fmt.Fprintf(w, "}\n")
+}
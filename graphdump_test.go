@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestDumpGraph(t *testing.T) {
+	_, cleanup := chdirTemp(t, "graphdump")
+	defer cleanup()
+	makefile := "Makefile"
+	err := ioutil.WriteFile(makefile, []byte(`all: prog | out
+prog: main.o "q.o"
+	cc $^ -o $@
+main.o: main.c
+	cc -c $< -o $@
+out:
+	mkdir $@
+.PHONY: all
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := Load(LoadReq{Makefile: makefile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = DumpGraph(&buf, g, GraphDumpOpt{Format: "dot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph kati {
+  node [shape=box];
+  "all" [shape=ellipse, style=filled, fillcolor=lightgray, tooltip="` + makefile + `"];
+  "prog" [tooltip="` + makefile + `:3"];
+  "out" [tooltip="` + makefile + `:7"];
+  "main.o" [tooltip="` + makefile + `:5"];
+  "\"q.o\"";
+  "main.c";
+  "all" -> "prog";
+  "all" -> "out" [style=dashed];
+  "prog" -> "main.o";
+  "prog" -> "\"q.o\"";
+  "main.o" -> "main.c";
+}
+`
+	if buf.String() != want {
+		t.Errorf("DumpGraph(dot)=%q; want=%q", buf.String(), want)
+	}
+
+	for _, tc := range []struct {
+		opt  GraphDumpOpt
+		want graphDump
+	}{
+		{
+			opt: GraphDumpOpt{Format: "json", Roots: []string{"prog"}, Depth: 1},
+			want: graphDump{
+				Nodes: []graphDumpNode{
+					{Target: "prog", Location: makefile + ":3", Commands: []string{"cc $^ -o $@"}},
+					{Target: "main.o", Location: makefile + ":5", Commands: []string{"cc -c $< -o $@"}, Truncated: true},
+					{Target: `"q.o"`},
+				},
+				Edges: []graphDumpEdge{
+					{From: "prog", To: "main.o"},
+					{From: "prog", To: `"q.o"`},
+				},
+			},
+		},
+		{
+			opt: GraphDumpOpt{Format: "json", Roots: []string{"out"}},
+			want: graphDump{
+				Nodes: []graphDumpNode{
+					{Target: "out", Location: makefile + ":7", Commands: []string{"mkdir $@"}},
+				},
+				Edges: []graphDumpEdge{},
+			},
+		},
+	} {
+		buf.Reset()
+		err = DumpGraph(&buf, g, tc.opt)
+		if err != nil {
+			t.Errorf("DumpGraph(%v)=%v", tc.opt, err)
+			continue
+		}
+		var got graphDump
+		err = json.Unmarshal(buf.Bytes(), &got)
+		if err != nil {
+			t.Errorf("DumpGraph(%v): %v\n%s", tc.opt, err, buf.Bytes())
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("DumpGraph(%v)=%+v; want=%+v", tc.opt, got, tc.want)
+		}
+	}
+
+	for _, opt := range []GraphDumpOpt{
+		{Format: "svg"},
+		{Format: "json", Roots: []string{"unknown"}},
+	} {
+		err = DumpGraph(&buf, g, opt)
+		if err == nil {
+			t.Errorf("DumpGraph(%v)=nil; want error", opt)
+		}
+	}
+}
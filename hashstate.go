@@ -0,0 +1,197 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"io"
+	"os"
+	"sync"
+)
+
+type fileDigest [sha1.Size]byte
+
+func digestFile(filename string) (fileDigest, error) {
+	var d fileDigest
+	f, err := os.Open(filename)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return d, err
+	}
+	copy(d[:], h.Sum(nil))
+	return d, nil
+}
+
+// hashRecord is the digests of the inputs and the output of a target
+// when it was built.
+type hashRecord struct {
+	Inputs []fileDigest
+	Output fileDigest
+}
+
+// hashState keeps the content digests of targets built before, so
+// recipes whose inputs have the same contents can be skipped even if
+// their timestamps are newer.
+type hashState struct {
+	mu       sync.Mutex
+	filename string
+	records  map[string]*hashRecord
+	// digests caches the digests of files in this run.
+	digests map[string]fileDigest
+}
+
+func loadHashState(filename string) (*hashState, error) {
+	hs := &hashState{
+		filename: filename,
+		records:  make(map[string]*hashRecord),
+		digests:  make(map[string]fileDigest),
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return hs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&hs.records)
+	if err != nil {
+		return nil, err
+	}
+	logStats("content hash state: %d records", len(hs.records))
+	return hs, nil
+}
+
+func (hs *hashState) save() error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	tmp := hs.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(hs.records)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, hs.filename)
+}
+
+func (hs *hashState) digest(filename string) (fileDigest, error) {
+	hs.mu.Lock()
+	d, ok := hs.digests[filename]
+	hs.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+	d, err := digestFile(filename)
+	if err != nil {
+		return d, err
+	}
+	hs.mu.Lock()
+	hs.digests[filename] = d
+	hs.mu.Unlock()
+	return d, nil
+}
+
+func (hs *hashState) lookup(output string) *hashRecord {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.records[output]
+}
+
+// newRecord computes the current digests of the inputs and the output
+// of n.
+func (hs *hashState) newRecord(n *DepNode) (*hashRecord, error) {
+	r := &hashRecord{}
+	for _, input := range n.ActualInputs {
+		d, err := hs.digest(input)
+		if err != nil {
+			return nil, err
+		}
+		r.Inputs = append(r.Inputs, d)
+	}
+	var err error
+	r.Output, err = hs.digest(n.Output)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// upToDate reports whether n has the same contents of the inputs and
+// the output as the last time it was built.
+func (hs *hashState) upToDate(n *DepNode) bool {
+	old := hs.lookup(n.Output)
+	if old == nil || len(old.Inputs) != len(n.ActualInputs) {
+		return false
+	}
+	r, err := hs.newRecord(n)
+	if err != nil {
+		logf("content hash of %s: %v", n.Output, err)
+		return false
+	}
+	if r.Output != old.Output {
+		return false
+	}
+	for i, d := range r.Inputs {
+		if d != old.Inputs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// record records the current contents of n, if not recorded yet.
+func (hs *hashState) record(n *DepNode) {
+	if hs.lookup(n.Output) != nil {
+		return
+	}
+	hs.update(n)
+}
+
+// rebuilt records the contents of n after its recipe ran, and reports
+// whether the output has the same contents as before.
+func (hs *hashState) rebuilt(n *DepNode) bool {
+	hs.mu.Lock()
+	delete(hs.digests, n.Output)
+	hs.mu.Unlock()
+	old := hs.lookup(n.Output)
+	r := hs.update(n)
+	return old != nil && r != nil && old.Output == r.Output
+}
+
+func (hs *hashState) update(n *DepNode) *hashRecord {
+	r, err := hs.newRecord(n)
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if err != nil {
+		logf("content hash of %s: %v", n.Output, err)
+		delete(hs.records, n.Output)
+		return nil
+	}
+	hs.records[n.Output] = r
+	return r
+}
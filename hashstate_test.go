@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		err := ioutil.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	n := &DepNode{
+		Output:       write("foo.o", "obj"),
+		ActualInputs: []string{write("foo.c", "src"), write("foo.h", "hdr")},
+	}
+	filename := filepath.Join(dir, "state")
+
+	hs, err := loadHashState(filename)
+	if err != nil {
+		t.Fatalf("loadHashState(%q)=_, %v", filename, err)
+	}
+	if hs.upToDate(n) {
+		t.Errorf("upToDate(foo.o)=true before recorded; want=false")
+	}
+	hs.record(n)
+	err = hs.save()
+	if err != nil {
+		t.Fatalf("save()=%v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"foo.h", "hdr", true},
+		{"foo.h", "new hdr", false},
+		{"foo.h", "hdr", true},
+		{"foo.o", "modified", false},
+	} {
+		write(tc.name, tc.content)
+		hs, err = loadHashState(filename)
+		if err != nil {
+			t.Fatalf("loadHashState(%q)=_, %v", filename, err)
+		}
+		if got := hs.upToDate(n); got != tc.want {
+			t.Errorf("upToDate(foo.o) with %s=%q: %t; want=%t", tc.name, tc.content, got, tc.want)
+		}
+	}
+
+	write("foo.o", "obj")
+	if !hs.rebuilt(n) {
+		t.Errorf("rebuilt(foo.o)=false for the same contents; want=true")
+	}
+	write("foo.o", "new obj")
+	if hs.rebuilt(n) {
+		t.Errorf("rebuilt(foo.o)=true for new contents; want=false")
+	}
+}
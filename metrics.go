@@ -0,0 +1,200 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// targetMetrics is the record of a job with a rule.
+type targetMetrics struct {
+	Target     string       `json:"target"`
+	Status     TargetStatus `json:"status"`
+	StartMs    float64      `json:"start_ms"`
+	DurationMs float64      `json:"duration_ms"`
+	Exit       int          `json:"exit,omitempty"`
+
+	n       *DepNode
+	elapsed time.Duration
+	// duration is the time spent for the critical path.
+	duration time.Duration
+}
+
+type metricsCounts struct {
+	Built    int `json:"built"`
+	UpToDate int `json:"up_to_date"`
+	Cached   int `json:"cached"`
+	Failed   int `json:"failed"`
+}
+
+type metricsCriticalPath struct {
+	DurationMs float64  `json:"duration_ms"`
+	Targets    []string `json:"targets"`
+}
+
+// buildMetrics collects the records of jobs for BuildResult and
+// --build_metrics.
+type buildMetrics struct {
+	mu        sync.Mutex
+	startTime time.Time
+	targets   []*targetMetrics
+
+	TotalTimeMs  float64             `json:"total_time_ms"`
+	Counts       metricsCounts       `json:"counts"`
+	CriticalPath metricsCriticalPath `json:"critical_path"`
+	Targets      []*targetMetrics    `json:"targets"`
+}
+
+func newBuildMetrics() *buildMetrics {
+	return &buildMetrics{
+		startTime: time.Now(),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (m *buildMetrics) add(j *job, startTime time.Time, d time.Duration) {
+	if !j.n.HasRule {
+		return
+	}
+	tm := &targetMetrics{
+		Target:     j.n.Output,
+		StartMs:    milliseconds(startTime.Sub(m.startTime)),
+		DurationMs: milliseconds(d),
+		Exit:       j.exit,
+		n:          j.n,
+		elapsed:    d,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch j.state {
+	case jobBuilt:
+		tm.Status = TargetBuilt
+		tm.duration = d
+		m.Counts.Built++
+	case jobCached:
+		tm.Status = TargetCached
+		tm.duration = d
+		m.Counts.Cached++
+	case jobUpToDate:
+		tm.Status = TargetUpToDate
+		m.Counts.UpToDate++
+	case jobFailed:
+		tm.Status = TargetFailed
+		tm.duration = d
+		m.Counts.Failed++
+	default:
+		return
+	}
+	m.targets = append(m.targets, tm)
+}
+
+// computeCriticalPath finds the chain of dependencies which took the
+// longest time to build.
+func (m *buildMetrics) computeCriticalPath() {
+	durations := make(map[*DepNode]time.Duration)
+	for _, tm := range m.targets {
+		durations[tm.n] = tm.duration
+	}
+	total := make(map[*DepNode]time.Duration)
+	next := make(map[*DepNode]*DepNode)
+	var visit func(n *DepNode) time.Duration
+	visit = func(n *DepNode) time.Duration {
+		if d, ok := total[n]; ok {
+			return d
+		}
+		// Cut circular dependencies.
+		total[n] = 0
+		var longest time.Duration
+		for _, deps := range [][]*DepNode{n.Deps, n.OrderOnlys} {
+			for _, d := range deps {
+				if t := visit(d); next[n] == nil || t > longest {
+					longest = t
+					next[n] = d
+				}
+			}
+		}
+		total[n] = durations[n] + longest
+		return total[n]
+	}
+	var root *DepNode
+	var longest time.Duration
+	for _, tm := range m.targets {
+		if t := visit(tm.n); root == nil || t > longest {
+			root = tm.n
+			longest = t
+		}
+	}
+	m.CriticalPath.DurationMs = milliseconds(longest)
+	var path []string
+	for n := root; n != nil; n = next[n] {
+		if _, ok := durations[n]; ok {
+			path = append(path, n.Output)
+		}
+	}
+	// From the first job to the last.
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	m.CriticalPath.Targets = path
+}
+
+func (m *buildMetrics) result() *BuildResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	targets := append([]*targetMetrics(nil), m.targets...)
+	sort.Sort(targetMetricsByStart(targets))
+	r := &BuildResult{}
+	for _, tm := range targets {
+		r.Targets = append(r.Targets, TargetResult{
+			Target:   tm.Target,
+			Status:   tm.Status,
+			Duration: tm.elapsed,
+			Exit:     tm.Exit,
+		})
+	}
+	return r
+}
+
+func (m *buildMetrics) write(filename string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.TotalTimeMs = milliseconds(time.Since(m.startTime))
+	m.computeCriticalPath()
+	m.Targets = append([]*targetMetrics(nil), m.targets...)
+	sort.Sort(targetMetricsByStart(m.Targets))
+	b, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+type targetMetricsByStart []*targetMetrics
+
+func (t targetMetricsByStart) Len() int      { return len(t) }
+func (t targetMetricsByStart) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t targetMetricsByStart) Less(i, j int) bool {
+	if t[i].StartMs != t[j].StartMs {
+		return t[i].StartMs < t[j].StartMs
+	}
+	return t[i].Target < t[j].Target
+}
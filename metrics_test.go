@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testMetrics returns the metrics of a build of the graph
+//
+//	all -> a -> c
+//	all -> b -> c
+//	all -> d (up to date)
+//
+// where c, a, b and all took 10, 5, 2 and 1 ms.
+func testMetrics() *buildMetrics {
+	c := &DepNode{Output: "c", HasRule: true}
+	a := &DepNode{Output: "a", HasRule: true, Deps: []*DepNode{c}}
+	b := &DepNode{Output: "b", HasRule: true, Deps: []*DepNode{c}}
+	d := &DepNode{Output: "d", HasRule: true}
+	all := &DepNode{Output: "all", HasRule: true, Deps: []*DepNode{a, b}, OrderOnlys: []*DepNode{d}}
+	m := newBuildMetrics()
+	for _, r := range []struct {
+		n     *DepNode
+		state jobState
+		start time.Duration
+		d     time.Duration
+	}{
+		{n: d, state: jobUpToDate, start: 0, d: 0},
+		{n: c, state: jobBuilt, start: 0, d: 10 * time.Millisecond},
+		{n: b, state: jobCached, start: 10 * time.Millisecond, d: 2 * time.Millisecond},
+		{n: a, state: jobBuilt, start: 10 * time.Millisecond, d: 5 * time.Millisecond},
+		{n: all, state: jobBuilt, start: 15 * time.Millisecond, d: time.Millisecond},
+	} {
+		m.add(&job{n: r.n, state: r.state}, m.startTime.Add(r.start), r.d)
+	}
+	return m
+}
+
+func TestComputeCriticalPath(t *testing.T) {
+	m := testMetrics()
+	m.computeCriticalPath()
+	if got, want := m.CriticalPath.DurationMs, 16.0; got != want {
+		t.Errorf("critical path duration=%v; want=%v", got, want)
+	}
+	if got, want := m.CriticalPath.Targets, []string{"c", "a", "all"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("critical path=%q; want=%q", got, want)
+	}
+}
+
+func TestBuildMetricsJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "metrics.json")
+	err = testMetrics().write(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Counts       map[string]int `json:"counts"`
+		CriticalPath struct {
+			DurationMs float64  `json:"duration_ms"`
+			Targets    []string `json:"targets"`
+		} `json:"critical_path"`
+		Targets []struct {
+			Target     string  `json:"target"`
+			Status     string  `json:"status"`
+			StartMs    float64 `json:"start_ms"`
+			DurationMs float64 `json:"duration_ms"`
+		} `json:"targets"`
+	}
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", filename, err, b)
+	}
+	if want := map[string]int{"built": 3, "up_to_date": 1, "cached": 1, "failed": 0}; !reflect.DeepEqual(got.Counts, want) {
+		t.Errorf("counts=%v; want=%v", got.Counts, want)
+	}
+	if got.CriticalPath.DurationMs != 16 || !reflect.DeepEqual(got.CriticalPath.Targets, []string{"c", "a", "all"}) {
+		t.Errorf("critical_path=%v; want 16 ms of c, a, all", got.CriticalPath)
+	}
+	var targets []string
+	for _, tm := range got.Targets {
+		targets = append(targets, tm.Target+" "+tm.Status)
+	}
+	// In order of starts, then names.
+	want := []string{"c built", "d up_to_date", "a built", "b cached", "all built"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("targets=%q; want=%q", targets, want)
+	}
+}
@@ -15,38 +15,177 @@
 package kati
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ninjaFile is build.ninja or a subninja file.
+type ninjaFile struct {
+	w      io.Writer
+	ruleID int
+	// rules maps rule bodies to their names.
+	rules map[string]string
+}
+
+func newNinjaFile(w io.Writer) *ninjaFile {
+	return &ninjaFile{w: w, rules: make(map[string]string)}
+}
+
 type ninjaGenerator struct {
-	f       *os.File
+	w       io.Writer
 	nodes   []*DepNode
 	exports map[string]bool
 
 	ctx *execContext
 
-	ruleID  int
-	done    map[string]bool
-	gomaDir string
+	done  map[string]bool
+	opt   NinjaOpt
+	pools map[string]int
+
+	// main is build.ninja, and subninjas are the subninja files
+	// keyed by directories of makefiles.
+	main      *ninjaFile
+	subninjas map[string]*ninjaFile
+	files     []*os.File
+
+	// exportValues are the values of the exported variables.
+	exportValues map[string]string
+
+	accessedMks   []*accessedMakefile
+	accessedGlobs []*accessedGlob
+	usedEnvs      []string
+	// stamp is set if build.ninja regenerates itself.
+	stamp *ninjaStamp
+	// ccWrapper is set if compile commands are run with a launcher.
+	ccWrapper *ccWrapper
+
+	// dedupRules shares a rule among nodes which have the same
+	// command, with $in and $out in the command.
+	dedupRules bool
 }
 
-var ccRE = regexp.MustCompile(`^prebuilts/(gcc|clang)/.*(gcc|g\+\+|clang|clang\+\+) .* -c `)
+// NinjaOpt is an option for GenerateNinjaWithOpt.
+type NinjaOpt struct {
+	// GomaDir is the directory of goma, to compile C/C++ files
+	// with gomacc. It is a shorthand of CCWrapper=<GomaDir>/gomacc
+	// and RemoteJobs=300.
+	GomaDir string
+	// CCWrapper is a compiler launcher, e.g. ccache, prepended to
+	// the commands matched by CCRegexp. Other commands run in
+	// local_pool.
+	CCWrapper string
+	// CCRegexp matches compile commands. If empty, the commands of
+	// the Android prebuilt compilers are matched.
+	CCRegexp string
+	// RemoteJobs, if positive, is passed to ninja as -j, for
+	// launchers which run compile commands remotely.
+	RemoteJobs int
+	// LocalPoolDepth is the depth of local_pool. If zero, the
+	// number of CPUs is used.
+	LocalPoolDepth int
+	// Args are the command line arguments of kati. If not empty,
+	// build.ninja has a rule to regenerate itself with them.
+	Args []string
+	// Dir is the directory to write build.ninja and ninja.sh. Paths
+	// in them are relative to the current directory.
+	Dir string
+	// Suffix is added to the names of the generated files, e.g.
+	// build<Suffix>.ninja.
+	Suffix string
+	// Subninjas splits build.ninja into subninja files for each
+	// directory of makefiles which define rules.
+	Subninjas bool
+	// Hermetic makes ninja.sh run ninja with `env -i`, keeping only
+	// the exported variables, the variables in HermeticEnv and the
+	// variables read by the makefiles, which are needed to
+	// regenerate build.ninja.
+	Hermetic bool
+	// HermeticEnv are the variables kept in the hermetic mode. If
+	// nil, defaultHermeticEnv is used.
+	HermeticEnv []string
+}
+
+var defaultHermeticEnv = []string{"HOME", "LANG", "PATH", "TERM", "TMPDIR", "USER"}
+
+// withGoma returns opt with CCWrapper and RemoteJobs set for GomaDir.
+func (opt NinjaOpt) withGoma() NinjaOpt {
+	if opt.GomaDir == "" {
+		return opt
+	}
+	if opt.CCWrapper == "" {
+		opt.CCWrapper = filepath.Join(opt.GomaDir, "gomacc")
+	}
+	if opt.RemoteJobs == 0 {
+		opt.RemoteJobs = 300
+	}
+	return opt
+}
 
-func newNinjaGenerator(g *DepGraph, gomaDir string) *ninjaGenerator {
+func (opt NinjaOpt) ninjaFile() string {
+	return filepath.Join(opt.Dir, "build"+opt.Suffix+".ninja")
+}
+
+func (opt NinjaOpt) shellFile() string {
+	return filepath.Join(opt.Dir, "ninja"+opt.Suffix+".sh")
+}
+
+func (opt NinjaOpt) stampFile() string {
+	return filepath.Join(opt.Dir, ".kati_stamp"+opt.Suffix)
+}
+
+// subninjaFile returns the subninja file for the rules defined in
+// makefiles in dir. Each component of dir is escaped, so different
+// directories never share a file: "_" is doubled, ".." is "_up",
+// "build.ninja" is "_build.ninja", and an absolute dir starts with
+// "_abs".
+func (opt NinjaOpt) subninjaFile(dir string) string {
+	dir = filepath.Clean(dir)
+	var elems []string
+	if filepath.IsAbs(dir) {
+		elems = append(elems, "_abs")
+	}
+	for _, elem := range strings.Split(dir, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			elems = append(elems, "_up")
+		case "build.ninja":
+			elems = append(elems, "_build.ninja")
+		default:
+			elems = append(elems, strings.Replace(elem, "_", "__", -1))
+		}
+	}
+	return filepath.Join(opt.Dir, "subninja"+opt.Suffix, filepath.Join(elems...), "build.ninja")
+}
+
+func newNinjaGenerator(g *DepGraph, opt NinjaOpt) *ninjaGenerator {
 	ctx := newExecContext(g.vars, true)
+	if len(opt.Args) > 0 {
+		// Records environment variables and globs used by recipes.
+		ctx.ev.cache = newAccessCache()
+	}
 	return &ninjaGenerator{
 		nodes:   g.nodes,
 		exports: g.exports,
 		ctx:     ctx,
 		done:    make(map[string]bool),
-		gomaDir: gomaDir,
+		opt:     opt,
+
+		accessedMks:   g.accessedMks,
+		accessedGlobs: g.accessedGlobs,
+		usedEnvs:      g.usedEnvs,
+
+		dedupRules: true,
+		subninjas:  make(map[string]*ninjaFile),
 	}
 }
 
@@ -154,7 +293,7 @@ func stripShellComment(s string) string {
 }
 
 func (n *ninjaGenerator) genShellScript(runners []runner) (string, bool) {
-	useGomacc := false
+	useWrapper := false
 	var buf bytes.Buffer
 	for i, r := range runners {
 		if i > 0 {
@@ -173,9 +312,10 @@ func (n *ninjaGenerator) genShellScript(runners []runner) (string, bool) {
 		if cmd == "" {
 			cmd = "true"
 		}
-		if n.gomaDir != "" && ccRE.MatchString(cmd) {
-			cmd = fmt.Sprintf("%s/gomacc %s", n.gomaDir, cmd)
-			useGomacc = true
+		var wrapped bool
+		cmd, wrapped = n.ccWrapper.wrap(cmd)
+		if wrapped {
+			useWrapper = true
 		}
 
 		needsSubShell := i > 0 || len(runners) > 1
@@ -194,27 +334,121 @@ func (n *ninjaGenerator) genShellScript(runners []runner) (string, bool) {
 			buf.WriteByte(')')
 		}
 	}
-	return buf.String(), n.gomaDir != "" && !useGomacc
+	return buf.String(), n.ccWrapper != nil && !useWrapper
 }
 
-func (n *ninjaGenerator) genRuleName() string {
-	ruleName := fmt.Sprintf("rule%d", n.ruleID)
-	n.ruleID++
+func (f *ninjaFile) genRuleName() string {
+	ruleName := fmt.Sprintf("rule%d", f.ruleID)
+	f.ruleID++
 	return ruleName
 }
 
-func (n *ninjaGenerator) emitBuild(output, rule, dep string) {
-	fmt.Fprintf(n.f, "build %s: %s%s\n", output, rule, dep)
+// ninjaWordSeps are the characters which may delimit paths in
+// commands.
+const ninjaWordSeps = " \t\n;&|()<>='\"`,"
+
+// isNinjaSafePath reports whether s can be replaced with $in or $out
+// without changing the command ninja runs. Ninja shell-escapes paths
+// in $in and $out which have characters other than these.
+func isNinjaSafePath(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range s {
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9':
+		case strings.ContainsRune("_+./-", ch):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// replaceWord replaces occurrences of old in s, which are delimited by
+// ninjaWordSeps, with new.
+func replaceWord(s, old, new string) string {
+	var buf bytes.Buffer
+	for {
+		i := strings.Index(s, old)
+		if i < 0 {
+			break
+		}
+		j := i + len(old)
+		if (i == 0 || strings.IndexByte(ninjaWordSeps, s[i-1]) >= 0) &&
+			(j == len(s) || strings.IndexByte(ninjaWordSeps, s[j]) >= 0) {
+			buf.WriteString(s[:i])
+			buf.WriteString(new)
+		} else {
+			buf.WriteString(s[:j])
+		}
+		s = s[j:]
+	}
+	if buf.Len() == 0 {
+		return s
+	}
+	buf.WriteString(s)
+	return buf.String()
+}
+
+// commandTemplate replaces the inputs and the output of node in cmd
+// with ${in} and ${out}, so nodes with the same command template can
+// share a rule.
+func commandTemplate(cmd string, node *DepNode) string {
+	var ins []string
+	for _, d := range node.Deps {
+		if !isNinjaSafePath(d.Output) {
+			ins = nil
+			break
+		}
+		ins = append(ins, d.Output)
+	}
+	if len(ins) > 0 {
+		cmd = replaceWord(cmd, strings.Join(ins, " "), "${in}")
+	}
+	if isNinjaSafePath(node.Output) {
+		cmd = replaceWord(cmd, node.Output, "${out}")
+	}
+	return cmd
+}
+
+// escapeNinjaPath escapes s for a path in build statements.
+func escapeNinjaPath(s string) string {
+	if strings.IndexAny(s, "$ :") < 0 {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '$', ' ', ':':
+			buf.WriteByte('$')
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// escapeNinjaPaths escapes paths and joins them with spaces.
+func escapeNinjaPaths(paths []string) string {
+	var escaped []string
+	for _, p := range paths {
+		escaped = append(escaped, escapeNinjaPath(p))
+	}
+	return strings.Join(escaped, " ")
+}
+
+func (f *ninjaFile) emitBuild(output, rule, dep string) {
+	fmt.Fprintf(f.w, "build %s: %s%s\n", escapeNinjaPath(output), rule, dep)
 }
 
 func getDepString(node *DepNode) string {
 	var deps []string
 	for _, d := range node.Deps {
-		deps = append(deps, d.Output)
+		deps = append(deps, escapeNinjaPath(d.Output))
 	}
 	var orderOnlys []string
 	for _, d := range node.OrderOnlys {
-		orderOnlys = append(orderOnlys, d.Output)
+		orderOnlys = append(orderOnlys, escapeNinjaPath(d.Output))
 	}
 	dep := ""
 	if len(deps) > 0 {
@@ -226,73 +460,317 @@ func getDepString(node *DepNode) string {
 	return dep
 }
 
-func (n *ninjaGenerator) emitNode(node *DepNode) error {
+// ninjaNode is a DepNode to emit with its expanded recipe.
+type ninjaNode struct {
+	node *DepNode
+
+	script       string
+	useLocalPool bool
+	depfile      string
+	pool         string
+	err          error
+
+	// Attributes set by target specific variables.
+	description    string
+	deps           string
+	restat         bool
+	rspfile        string
+	rspfileContent string
+}
+
+// Target specific variables to control the attributes of build
+// statements, e.g.
+//
+//	out/foo.o: .KATI_DEPFILE := out/foo.d
+//	out/foo.o: .KATI_DEPS := gcc
+//
+// The depfile is guessed from the command only if .KATI_DEPFILE is not
+// set. .KATI_RSPFILE_CONTENT defaults to $in.
+const (
+	ninjaDescriptionVar    = ".KATI_DESCRIPTION"
+	ninjaDepfileVar        = ".KATI_DEPFILE"
+	ninjaDepsVar           = ".KATI_DEPS"
+	ninjaRestatVar         = ".KATI_RESTAT"
+	ninjaRspfileVar        = ".KATI_RSPFILE"
+	ninjaRspfileContentVar = ".KATI_RSPFILE_CONTENT"
+)
+
+// hasNinjaBuild reports whether node has a build statement.
+func hasNinjaBuild(node *DepNode) bool {
+	return len(node.Cmds) > 0 || len(node.Deps) > 0 || len(node.OrderOnlys) > 0 || node.IsPhony
+}
+
+// collectNodes appends node and its dependencies to nodes in the order
+// to emit.
+func (n *ninjaGenerator) collectNodes(node *DepNode, nodes []*ninjaNode) []*ninjaNode {
 	if n.done[node.Output] {
-		return nil
+		return nodes
 	}
 	n.done[node.Output] = true
 
-	if len(node.Cmds) == 0 && len(node.Deps) == 0 && len(node.OrderOnlys) == 0 && !node.IsPhony {
+	if !hasNinjaBuild(node) {
+		return nodes
+	}
+	nodes = append(nodes, &ninjaNode{node: node})
+	for _, d := range node.Deps {
+		nodes = n.collectNodes(d, nodes)
+	}
+	for _, d := range node.OrderOnlys {
+		nodes = n.collectNodes(d, nodes)
+	}
+	return nodes
+}
+
+// expandNodes expands recipes of nodes in parallel. If a recipe
+// assigns variables with $(eval), they are expanded again in order, as
+// the later recipes may see the variables.
+func (n *ninjaGenerator) expandNodes(nodes []*ninjaNode) {
+	ch := make(chan *ninjaNode, len(nodes))
+	for _, nn := range nodes {
+		ch <- nn
+	}
+	close(ch)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for nn := range ch {
+				nn.err = n.expandNode(nn)
+			}
+		}()
+	}
+	wg.Wait()
+	if n.ctx.evalVars.count() == 0 {
+		return
+	}
+	n.ctx.evalVars.reset()
+	for _, nn := range nodes {
+		nn.err = n.expandNode(nn)
+	}
+}
+
+func (n *ninjaGenerator) expandNode(nn *ninjaNode) error {
+	runners, _, err := createRunners(n.ctx, nn.node)
+	if err != nil {
+		return err
+	}
+	nn.pool, err = nodePool(n.ctx, nn.node, n.pools)
+	if err != nil {
+		return err
+	}
+	if len(runners) == 0 {
 		return nil
 	}
+	nn.script, nn.useLocalPool = n.genShellScript(runners)
+	err = n.evalNinjaVars(nn)
+	if err != nil {
+		return err
+	}
+	if n.dedupRules {
+		nn.script = commandTemplate(nn.script, nn.node)
+	}
+	// The rule of a long command has its own rspfile, which would
+	// be overridden.
+	if nn.rspfile != "" && len(nn.script) > ninjaArgLenLimit {
+		return fmt.Errorf("[%s] %s cannot be used for a command longer than %d bytes", nn.node.Output, ninjaRspfileVar, ninjaArgLenLimit)
+	}
+	return nil
+}
+
+// ninjaArgLenLimit is the limit of the length of a command. A longer
+// command runs from an rspfile.
+// It seems Linux is OK with ~130kB.
+// TODO: Find this number automatically.
+const ninjaArgLenLimit = 100 * 1000
 
-	runners, _, err := createRunners(n.ctx, node)
+// evalNinjaVars sets the attributes of nn by its target specific
+// variables.
+func (n *ninjaGenerator) evalNinjaVars(nn *ninjaNode) error {
+	node := nn.node
+	eval := func(name string) (string, bool, error) {
+		v, ok, err := evalTargetSpecificVar(n.ctx, node, name)
+		return strings.Replace(v, "\n", " ", -1), ok, err
+	}
+	depfile, ok, err := eval(ninjaDepfileVar)
 	if err != nil {
 		return err
 	}
-	ruleName := "phony"
-	useLocalPool := false
-	if len(runners) > 0 {
-		ruleName = n.genRuleName()
-		fmt.Fprintf(n.f, "\n# rule for %s\n", node.Output)
-		fmt.Fprintf(n.f, "rule %s\n", ruleName)
-		fmt.Fprintf(n.f, " description = build $out\n")
-
-		ss, ulp := n.genShellScript(runners)
-		if ulp {
-			useLocalPool = true
-		}
-		depfile, err := getDepfile(ss)
+	if ok {
+		nn.depfile = depfile
+	} else {
+		nn.depfile, err = getDepfile(nn.script)
 		if err != nil {
 			return err
 		}
-		if depfile != "" {
-			fmt.Fprintf(n.f, " depfile = %s\n", depfile)
-		}
-		// It seems Linux is OK with ~130kB.
-		// TODO: Find this number automatically.
-		ArgLenLimit := 100 * 1000
-		if len(ss) > ArgLenLimit {
-			fmt.Fprintf(n.f, " rspfile = $out.rsp\n")
-			fmt.Fprintf(n.f, " rspfile_content = %s\n", ss)
-			ss = "sh $out.rsp"
+	}
+	nn.deps, _, err = eval(ninjaDepsVar)
+	if err != nil {
+		return err
+	}
+	switch nn.deps {
+	case "", "msvc":
+	case "gcc":
+		if nn.depfile == "" {
+			return fmt.Errorf("[%s] %s is set without a depfile", node.Output, ninjaDepsVar)
 		}
-		fmt.Fprintf(n.f, " command = %s\n", ss)
+	default:
+		return fmt.Errorf("[%s] invalid %s: %q", node.Output, ninjaDepsVar, nn.deps)
+	}
+	restat, _, err := eval(ninjaRestatVar)
+	if err != nil {
+		return err
+	}
+	switch restat {
+	case "":
+	case "1", "true":
+		nn.restat = true
+	default:
+		return fmt.Errorf("[%s] invalid %s: %q", node.Output, ninjaRestatVar, restat)
+	}
+	nn.description, _, err = eval(ninjaDescriptionVar)
+	if err != nil {
+		return err
+	}
+	nn.rspfile, _, err = eval(ninjaRspfileVar)
+	if err != nil {
+		return err
+	}
+	nn.rspfileContent, ok, err = eval(ninjaRspfileContentVar)
+	if err != nil {
+		return err
+	}
+	if ok {
+		nn.rspfileContent = escapeNinjaValue(nn.rspfileContent)
+	} else {
+		nn.rspfileContent = "$in"
+	}
+	return nil
+}
 
+// escapeNinjaValue escapes s for the value of a ninja variable.
+func escapeNinjaValue(s string) string {
+	return strings.Replace(s, "$", "$$", -1)
+}
+
+// fileFor returns the ninja file to emit node.
+func (n *ninjaGenerator) fileFor(node *DepNode) (*ninjaFile, error) {
+	if !n.opt.Subninjas || node.Filename == "" {
+		return n.main, nil
+	}
+	dir := filepath.Dir(node.Filename)
+	if f, ok := n.subninjas[dir]; ok {
+		return f, nil
+	}
+	filename := n.opt.subninjaFile(dir)
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return nil, err
 	}
-	n.emitBuild(node.Output, ruleName, getDepString(node))
-	if useLocalPool {
-		fmt.Fprintf(n.f, " pool = local_pool\n")
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Fprintf(n.f, "\n")
+	n.files = append(n.files, file)
+	f := newNinjaFile(bufio.NewWriter(file))
+	fmt.Fprintf(f.w, "# Generated by kati for makefiles in %s\n", dir)
+	n.subninjas[dir] = f
+	return f, nil
+}
 
-	for _, d := range node.Deps {
-		err := n.emitNode(d)
-		if err != nil {
-			return err
+// closeSubninjas flushes and closes the subninja files.
+func (n *ninjaGenerator) closeSubninjas() error {
+	var err error
+	for _, f := range n.subninjas {
+		if ferr := f.w.(*bufio.Writer).Flush(); err == nil {
+			err = ferr
 		}
 	}
-	for _, d := range node.OrderOnlys {
-		err := n.emitNode(d)
-		if err != nil {
-			return err
+	for _, file := range n.files {
+		if cerr := file.Close(); err == nil {
+			err = cerr
 		}
 	}
+	n.files = nil
+	return err
+}
+
+func (n *ninjaGenerator) emitNode(nn *ninjaNode) error {
+	node := nn.node
+	f, err := n.fileFor(node)
+	if err != nil {
+		return err
+	}
+	ruleName := "phony"
+	if nn.script != "" {
+		ruleName = n.emitRule(f, nn)
+	}
+	pool := nn.pool
+	if pool == "" && nn.useLocalPool {
+		pool = "local_pool"
+	}
+	f.emitBuild(node.Output, ruleName, getDepString(node))
+	if n.dedupRules && nn.depfile != "" {
+		fmt.Fprintf(f.w, " depfile = %s\n", escapeNinjaValue(nn.depfile))
+	}
+	if nn.deps != "" {
+		fmt.Fprintf(f.w, " deps = %s\n", nn.deps)
+	}
+	if nn.description != "" {
+		fmt.Fprintf(f.w, " description = %s\n", escapeNinjaValue(nn.description))
+	}
+	if nn.restat {
+		fmt.Fprintf(f.w, " restat = 1\n")
+	}
+	if nn.rspfile != "" {
+		fmt.Fprintf(f.w, " rspfile = %s\n", escapeNinjaValue(nn.rspfile))
+		fmt.Fprintf(f.w, " rspfile_content = %s\n", nn.rspfileContent)
+	}
+	if pool != "" {
+		fmt.Fprintf(f.w, " pool = %s\n", pool)
+	}
+	fmt.Fprintf(f.w, "\n")
 	return nil
 }
 
+// emitRule emits the rule for nn in f if needed, and returns its name.
+func (n *ninjaGenerator) emitRule(f *ninjaFile, nn *ninjaNode) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, " description = build $out\n")
+	ss := nn.script
+	// With dedupRules, depfile is bound in the build statement.
+	if nn.depfile != "" && !n.dedupRules {
+		fmt.Fprintf(&buf, " depfile = %s\n", nn.depfile)
+	}
+	if len(ss) > ninjaArgLenLimit {
+		fmt.Fprintf(&buf, " rspfile = $out.rsp\n")
+		fmt.Fprintf(&buf, " rspfile_content = %s\n", ss)
+		ss = "sh $out.rsp"
+	}
+	fmt.Fprintf(&buf, " command = %s\n", ss)
+	body := buf.String()
+
+	if n.dedupRules {
+		if ruleName, ok := f.rules[body]; ok {
+			return ruleName
+		}
+	}
+	ruleName := f.genRuleName()
+	if n.dedupRules {
+		f.rules[body] = ruleName
+	}
+	if n.dedupRules {
+		fmt.Fprintf(f.w, "\n")
+	} else {
+		fmt.Fprintf(f.w, "\n# rule for %s\n", nn.node.Output)
+	}
+	fmt.Fprintf(f.w, "rule %s\n", ruleName)
+	io.WriteString(f.w, body)
+	return ruleName
+}
+
 func (n *ninjaGenerator) generateShell() (err error) {
-	f, err := os.Create("ninja.sh")
+	f, err := os.Create(n.opt.shellFile())
 	if err != nil {
 		return err
 	}
@@ -304,28 +782,107 @@ func (n *ninjaGenerator) generateShell() (err error) {
 	}()
 
 	fmt.Fprintf(f, "#!%s\n", n.ctx.shell)
-	for name, export := range n.exports {
-		if export {
-			v, err := n.ctx.ev.EvaluateVar(name)
-			if err != nil {
-				return err
+	if n.stamp != nil {
+		n.stamp.writeEnvCheck(f, n.opt.stampFile())
+	}
+	var env []string
+	if n.opt.Hermetic {
+		for _, name := range n.hermeticEnv() {
+			env = append(env, fmt.Sprintf(`${%s+"%s=$%s"}`, name, name, name))
+		}
+	}
+	if n.stamp != nil {
+		// build.ninja is regenerated with the environment before
+		// the exports.
+		for _, name := range sortedExports(n.exports) {
+			if !shellVarNameRE.MatchString(name) {
+				continue
 			}
-			fmt.Fprintf(f, "export %s=%s\n", name, v)
-		} else {
+			if n.opt.Hermetic {
+				env = append(env, origEnvName(name)+"="+origEnvValue(name))
+			} else {
+				fmt.Fprintf(f, "export %s=%s\n", origEnvName(name), origEnvValue(name))
+			}
+		}
+	}
+	for _, name := range sortedExports(n.exports) {
+		switch {
+		case n.opt.Hermetic && n.exports[name]:
+			env = append(env, name+"="+shellQuote(n.exportValues[name]))
+		case n.opt.Hermetic:
+			// Not passed to env -i.
+		case n.exports[name]:
+			fmt.Fprintf(f, "export %s=%s\n", name, shellQuote(n.exportValues[name]))
+		default:
 			fmt.Fprintf(f, "unset %s\n", name)
 		}
 	}
-	if n.gomaDir == "" {
-		fmt.Fprintln(f, `exec ninja "$@"`)
+	var args string
+	if n.opt.ninjaFile() != "build.ninja" {
+		args += " -f " + shellQuote(n.opt.ninjaFile())
+	}
+	if n.opt.RemoteJobs > 0 {
+		args += fmt.Sprintf(" -j%d", n.opt.RemoteJobs)
+	}
+	if n.opt.Hermetic {
+		fmt.Fprintf(f, "exec env -i")
+		for _, e := range env {
+			fmt.Fprintf(f, " \\\n  %s", e)
+		}
+		fmt.Fprintf(f, " \\\n  ninja%s \"$@\"\n", args)
 	} else {
-		fmt.Fprintln(f, `exec ninja -j300 "$@"`)
+		fmt.Fprintf(f, "exec ninja%s \"$@\"\n", args)
 	}
 
 	return f.Chmod(0755)
 }
 
+// hermeticEnv returns the variables ninja.sh passes through in the
+// hermetic mode, other than the exported ones.
+func (n *ninjaGenerator) hermeticEnv() []string {
+	names := n.opt.HermeticEnv
+	if names == nil {
+		names = defaultHermeticEnv
+	}
+	names = append([]string(nil), names...)
+	if n.stamp != nil {
+		for _, e := range n.stamp.Envs {
+			names = append(names, e.Name)
+		}
+	}
+	var r []string
+	for _, name := range sortedUniq(names) {
+		if _, ok := n.exports[name]; ok || !shellVarNameRE.MatchString(name) {
+			continue
+		}
+		r = append(r, name)
+	}
+	return r
+}
+
+func (n *ninjaGenerator) evalExports() error {
+	n.exportValues = make(map[string]string)
+	for name, export := range n.exports {
+		if !export {
+			continue
+		}
+		v, err := n.ctx.ev.EvaluateVar(name)
+		if err != nil {
+			return err
+		}
+		n.exportValues[name] = v
+	}
+	return nil
+}
+
 func (n *ninjaGenerator) generateNinja() (err error) {
-	f, err := os.Create("build.ninja")
+	if n.opt.Dir != "" {
+		err = os.MkdirAll(n.opt.Dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(n.opt.ninjaFile())
 	if err != nil {
 		return err
 	}
@@ -335,30 +892,142 @@ func (n *ninjaGenerator) generateNinja() (err error) {
 			err = cerr
 		}
 	}()
+	w := bufio.NewWriter(f)
+	err = n.writeNinja(w)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
 
-	n.f = f
-	fmt.Fprintf(n.f, "# Generated by kati\n")
-	fmt.Fprintf(n.f, "\n")
+func (n *ninjaGenerator) writeNinja(w io.Writer) error {
+	n.w = w
+	n.main = newNinjaFile(w)
+	fmt.Fprintf(n.w, "# Generated by kati\n")
+	fmt.Fprintf(n.w, "\n")
 
-	if n.gomaDir != "" {
-		fmt.Fprintf(n.f, "pool local_pool\n")
-		fmt.Fprintf(n.f, " depth = %d\n", runtime.NumCPU())
+	if n.ccWrapper != nil {
+		depth := n.opt.LocalPoolDepth
+		if depth <= 0 {
+			depth = runtime.NumCPU()
+		}
+		fmt.Fprintf(n.w, "pool local_pool\n")
+		fmt.Fprintf(n.w, " depth = %d\n", depth)
+	}
+	var err error
+	n.pools, err = declaredPools(n.ctx.ev, n.ctx.ev.vars)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedPoolNames(n.pools) {
+		fmt.Fprintf(n.w, "pool %s\n", name)
+		fmt.Fprintf(n.w, " depth = %d\n", n.pools[name])
 	}
 
+	// Recipes are expanded in parallel, and emitted in the order of
+	// the dependency graph.
+	var nodes []*ninjaNode
 	for _, node := range n.nodes {
-		err := n.emitNode(node)
+		nodes = n.collectNodes(node, nodes)
+	}
+	n.expandNodes(nodes)
+	if len(n.opt.Args) > 0 {
+		envs := append(append([]string(nil), n.usedEnvs...), n.ctx.ev.cache.Envs()...)
+		globs := append(append([]*accessedGlob(nil), n.accessedGlobs...), n.ctx.ev.cache.Globs()...)
+		n.stamp = newNinjaStamp(n.opt.Args, n.accessedMks, sortedUniq(envs), globs, androidFindCache.dirs())
+		n.emitRegenRule()
+	}
+	for _, nn := range nodes {
+		if nn.err != nil {
+			n.closeSubninjas()
+			return nn.err
+		}
+		err := n.emitNode(nn)
 		if err != nil {
+			n.closeSubninjas()
 			return err
 		}
 	}
-	return nil
+	var dirs []string
+	for dir := range n.subninjas {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		fmt.Fprintf(n.w, "subninja %s\n", escapeNinjaPath(n.opt.subninjaFile(dir)))
+	}
+	n.emitAliases(nodes)
+	n.emitDefault()
+	return n.closeSubninjas()
+}
+
+// emitAliases emits phony targets of the basenames of outputs, if they
+// are unique.
+func (n *ninjaGenerator) emitAliases(nodes []*ninjaNode) {
+	aliases := make(map[string][]string)
+	for _, nn := range nodes {
+		output := nn.node.Output
+		if len(nn.node.Cmds) == 0 || nn.node.IsPhony || !strings.Contains(output, "/") {
+			continue
+		}
+		base := filepath.Base(output)
+		aliases[base] = append(aliases[base], output)
+	}
+	reserved := map[string]bool{n.opt.ninjaFile(): true}
+	if n.stamp != nil {
+		for _, input := range n.regenInputs() {
+			reserved[input] = true
+		}
+	}
+	var names []string
+	for name, outputs := range aliases {
+		// Do not shadow any files or other targets.
+		if len(outputs) > 1 || n.done[name] || reserved[name] {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	fmt.Fprintf(n.w, "\n# Short names of targets.\n")
+	for _, name := range names {
+		n.main.emitBuild(name, "phony", " "+escapeNinjaPath(aliases[name][0]))
+	}
+}
+
+// emitDefault emits the default targets, which are the goals of make.
+func (n *ninjaGenerator) emitDefault() {
+	var targets []string
+	for _, node := range n.nodes {
+		if hasNinjaBuild(node) {
+			targets = append(targets, node.Output)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	fmt.Fprintf(n.w, "\ndefault %s\n", escapeNinjaPaths(targets))
 }
 
 // GenerateNinja generates build.ninja from DepGraph.
 func GenerateNinja(g *DepGraph, gomaDir string) error {
+	return GenerateNinjaWithOpt(g, NinjaOpt{GomaDir: gomaDir})
+}
+
+// GenerateNinjaWithOpt generates build.ninja from DepGraph with opt.
+func GenerateNinjaWithOpt(g *DepGraph, opt NinjaOpt) error {
 	startTime := time.Now()
-	n := newNinjaGenerator(g, gomaDir)
-	err := n.generateShell()
+	opt = opt.withGoma()
+	g.reportCycles(os.Stderr)
+	n := newNinjaGenerator(g, opt)
+	var err error
+	n.ccWrapper, err = newCCWrapper(opt.CCWrapper, opt.CCRegexp)
+	if err != nil {
+		return err
+	}
+	err = n.evalExports()
 	if err != nil {
 		return err
 	}
@@ -366,6 +1035,22 @@ func GenerateNinja(g *DepGraph, gomaDir string) error {
 	if err != nil {
 		return err
 	}
+	if n.stamp != nil {
+		fi, err := os.Stat(n.opt.ninjaFile())
+		if err != nil {
+			return err
+		}
+		err = n.stamp.write(n.opt.stampFile(), fi.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	// ninja.sh checks the environment variables used, which are
+	// known after build.ninja is generated.
+	err = n.generateShell()
+	if err != nil {
+		return err
+	}
 	logStats("generate ninja time: %q", time.Since(startTime))
 	return nil
 }
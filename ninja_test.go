@@ -14,7 +14,42 @@
 
 package kati
 
-import "testing"
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chdirTemp changes the working directory to a new temporary
+// directory. The returned function restores the working directory and
+// removes the temporary directory.
+func chdirTemp(t *testing.T, prefix string) (string, func()) {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
 
 func TestStripShellComment(t *testing.T) {
 	for _, tc := range []struct {
@@ -149,3 +184,781 @@ func TestGetDepFile(t *testing.T) {
 		}
 	}
 }
+
+func TestCommandTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		cmd    string
+		output string
+		inputs []string
+		want   string
+	}{
+		{
+			cmd:    "cc -c foo.c -o foo.o",
+			output: "foo.o",
+			inputs: []string{"foo.c"},
+			want:   "cc -c ${in} -o ${out}",
+		},
+		{
+			cmd:    "ar rcs lib.a a.o b.o",
+			output: "lib.a",
+			inputs: []string{"a.o", "b.o"},
+			want:   "ar rcs ${out} ${in}",
+		},
+		{
+			cmd:    "cp a.o out/a.o.bak && touch a.o.stamp",
+			output: "a.o",
+			want:   "cp ${out} out/a.o.bak && touch a.o.stamp",
+		},
+		{
+			cmd:    "echo $$foo > foo",
+			output: "foo",
+			want:   "echo $$foo > ${out}",
+		},
+		{
+			cmd:    "cp 'a b' a:b",
+			output: "a:b",
+			inputs: []string{"a b"},
+			want:   "cp 'a b' a:b",
+		},
+		{
+			cmd:    `cc -c "a@b.c" -o "out/a@b.o"`,
+			output: "out/a@b.o",
+			inputs: []string{"a@b.c"},
+			want:   `cc -c "a@b.c" -o "out/a@b.o"`,
+		},
+		{
+			cmd:    "cp src/*.h out/~x.h",
+			output: "out/~x.h",
+			inputs: []string{"src/*.h"},
+			want:   "cp src/*.h out/~x.h",
+		},
+	} {
+		n := &DepNode{Output: tc.output}
+		for _, input := range tc.inputs {
+			n.Deps = append(n.Deps, &DepNode{Output: input})
+		}
+		got := commandTemplate(tc.cmd, n)
+		if got != tc.want {
+			t.Errorf("commandTemplate(%q, %q)=%q; want=%q", tc.cmd, tc.output, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaDedupRules(t *testing.T) {
+	all := &DepNode{Output: "all", IsPhony: true, HasRule: true}
+	for i := 0; i < 100; i++ {
+		src := &DepNode{Output: fmt.Sprintf("src/f%d.c", i)}
+		obj := &DepNode{
+			Output:       fmt.Sprintf("out/f%d.o", i),
+			Cmds:         []string{"prebuilts/clang/bin/clang -O2 -Wall -MD -c $< -o $@"},
+			Deps:         []*DepNode{src},
+			ActualInputs: []string{src.Output},
+			HasRule:      true,
+		}
+		all.Deps = append(all.Deps, obj)
+	}
+	g := &DepGraph{nodes: []*DepNode{all}, vars: make(Vars)}
+
+	var sizes []int
+	for _, dedup := range []bool{false, true} {
+		n := newNinjaGenerator(g, NinjaOpt{})
+		n.dedupRules = dedup
+		var buf bytes.Buffer
+		err := n.writeNinja(&buf)
+		if err != nil {
+			t.Fatalf("writeNinja (dedup=%t)=%v", dedup, err)
+		}
+		sizes = append(sizes, buf.Len())
+		if dedup {
+			if got := strings.Count(buf.String(), "\nrule "); got != 1 {
+				t.Errorf("rules=%d; want=1\n%s", got, buf.String())
+			}
+			if !strings.Contains(buf.String(), "build out/f0.o: rule0 src/f0.c\n depfile = out/f0.d\n") {
+				t.Errorf("no build for out/f0.o\n%s", buf.String())
+			}
+		}
+	}
+	if sizes[1]*2 > sizes[0] {
+		t.Errorf("size with dedup=%d; want less than half of %d", sizes[1], sizes[0])
+	}
+}
+
+func TestNinjaRegen(t *testing.T) {
+	_, cleanup := chdirTemp(t, "ninja")
+	defer cleanup()
+	err := os.Mkdir("src", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"Makefile": `SRCS := $(wildcard src/*.c)
+include sub.mk
+-include missing/opt.mk
+all: $(SRCS:.c=.o)
+%.o: %.c
+	cc $(KATI_TEST_CFLAGS) -c $< -o $@
+`,
+		"sub.mk":  "X := $(KATI_TEST_X)\n",
+		"src/a.c": "",
+	} {
+		err := ioutil.WriteFile(name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Unsetenv("KATI_TEST_X")
+	os.Setenv("KATI_TEST_X", "it's")
+
+	g, err := Load(LoadReq{Makefile: "Makefile", TrackAccesses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenerateNinjaWithOpt(g, NinjaOpt{Args: []string{"kati", "--ninja"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// missing/opt.mk is checked only by --regen, as "." changes on
+	// every build.
+	want := "build build.ninja: regen_ninja .kati_stamp Makefile src sub.mk\n"
+	if !strings.Contains(string(b), want) {
+		t.Errorf("build.ninja does not have %q\n%s", want, b)
+	}
+	b, err = ioutil.ReadFile("ninja.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`[ "${KATI_TEST_CFLAGS+set}${KATI_TEST_CFLAGS-}" = '' ] || touch .kati_stamp`,
+		`[ "${KATI_TEST_X+set}${KATI_TEST_X-}" = 'setit'\''s' ] || touch .kati_stamp`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("ninja.sh does not have %q\n%s", want, b)
+		}
+	}
+	st, err := os.Stat(".kati_stamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt, err := os.Stat("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ModTime().After(nt.ModTime()) {
+		t.Errorf("stamp %v is newer than build.ninja %v", st.ModTime(), nt.ModTime())
+	}
+
+	err = os.Mkdir("missing", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("missing/opt.mk", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := NinjaOpt{Args: []string{"kati", "--ninja"}}
+	if got, want := NinjaRegenReason(opt), "missing/opt.mk was created"; got != want {
+		t.Errorf("NinjaRegenReason()=%q; want=%q", got, want)
+	}
+}
+
+func TestNinjaStampCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mk := filepath.Join(dir, "a.mk")
+	err = ioutil.WriteFile(mk, []byte("A := 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.mk")
+	pat := filepath.Join(dir, "*.c")
+	defer os.Unsetenv("KATI_TEST_ENV")
+	os.Setenv("KATI_TEST_ENV", "foo")
+
+	args := []string{"kati", "--ninja", "--regen"}
+	newStamp := func() *ninjaStamp {
+		files, err := wildcardGlob(pat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ioutil.ReadFile(mk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newNinjaStamp(args, []*accessedMakefile{
+			{Filename: mk, Hash: sha1.Sum(c), State: fileExists},
+			{Filename: missing, State: fileNotExists},
+		}, []string{"KATI_TEST_ENV"}, []*accessedGlob{{Pattern: pat, Files: files}},
+			[]stampDir{{Path: dir, Mtime: fi.ModTime().UnixNano()}})
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func()
+		args   []string
+		want   string
+	}{
+		{
+			name:   "no change",
+			change: func() {},
+		},
+		{
+			name: "same contents",
+			change: func() {
+				now := time.Now().Add(time.Hour)
+				os.Chtimes(mk, now, now)
+			},
+		},
+		{
+			name: "without regen flag",
+			args: []string{"kati", "--ninja"},
+		},
+		{
+			name: "flags",
+			args: []string{"kati", "--ninja", "-j", "4"},
+			want: "command line flags were changed",
+		},
+		{
+			name:   "env",
+			change: func() { os.Setenv("KATI_TEST_ENV", "bar") },
+			want:   "environment variable KATI_TEST_ENV was changed",
+		},
+		{
+			name:   "modified",
+			change: func() { ioutil.WriteFile(mk, []byte("A := 2\n"), 0644) },
+			want:   mk + " was modified",
+		},
+		{
+			name:   "created",
+			change: func() { ioutil.WriteFile(missing, nil, 0644) },
+			want:   missing + " was created",
+		},
+		{
+			name:   "glob",
+			change: func() { ioutil.WriteFile(filepath.Join(dir, "a.c"), nil, 0644) },
+			want:   "wildcard(" + pat + ") was changed",
+		},
+		{
+			name:   "find",
+			change: func() { ioutil.WriteFile(filepath.Join(dir, "b.txt"), nil, 0644) },
+			want:   "directory " + dir + " was changed",
+		},
+	} {
+		os.Remove(missing)
+		os.Remove(filepath.Join(dir, "a.c"))
+		os.Remove(filepath.Join(dir, "b.txt"))
+		os.Setenv("KATI_TEST_ENV", "foo")
+		st := newStamp()
+		if tc.change != nil {
+			tc.change()
+		}
+		a := args
+		if tc.args != nil {
+			a = tc.args
+		}
+		got := st.check(a)
+		if got != tc.want {
+			t.Errorf("%s: check(%q)=%q; want=%q", tc.name, a, got, tc.want)
+		}
+	}
+}
+
+func TestSubninjaFile(t *testing.T) {
+	opt := NinjaOpt{Dir: "out", Suffix: "-p"}
+	files := make(map[string]string)
+	for _, tc := range []struct {
+		dir  string
+		want string
+	}{
+		{dir: ".", want: "out/subninja-p/build.ninja"},
+		{dir: "foo/bar/", want: "out/subninja-p/foo/bar/build.ninja"},
+		{dir: "/foo", want: "out/subninja-p/_abs/foo/build.ninja"},
+		{dir: "_abs/foo", want: "out/subninja-p/__abs/foo/build.ninja"},
+		{dir: "../foo", want: "out/subninja-p/_up/foo/build.ninja"},
+		{dir: "__/foo", want: "out/subninja-p/____/foo/build.ninja"},
+		{dir: "_up/foo", want: "out/subninja-p/__up/foo/build.ninja"},
+		{dir: "foo", want: "out/subninja-p/foo/build.ninja"},
+		{dir: "foo/build.ninja", want: "out/subninja-p/foo/_build.ninja/build.ninja"},
+		{dir: "a_b", want: "out/subninja-p/a__b/build.ninja"},
+	} {
+		got := opt.subninjaFile(tc.dir)
+		if got != tc.want {
+			t.Errorf("subninjaFile(%q)=%q; want=%q", tc.dir, got, tc.want)
+		}
+		if dir, ok := files[got]; ok {
+			t.Errorf("subninjaFile(%q)=subninjaFile(%q)=%q", tc.dir, dir, got)
+		}
+		files[got] = tc.dir
+	}
+	// A file must not be used as a directory by another.
+	for f := range files {
+		for g := range files {
+			if strings.HasPrefix(g, f+"/") {
+				t.Errorf("%q is under %q", g, f)
+			}
+		}
+	}
+}
+
+func TestNinjaDirSuffixSubninjas(t *testing.T) {
+	_, cleanup := chdirTemp(t, "ninja")
+	defer cleanup()
+	err := os.Mkdir("sub", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"Makefile": `all: top.o sub/a.o
+top.o: top.c
+	cc -c $< -o $@
+include sub/a.mk
+`,
+		"sub/a.mk": "sub/a.o: sub/a.c\n\tcc -c $< -o $@\n",
+	} {
+		err := ioutil.WriteFile(name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile", TrackAccesses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := NinjaOpt{
+		Args:      []string{"kati", "--ninja"},
+		Dir:       "out",
+		Suffix:    "-p",
+		Subninjas: true,
+	}
+	err = GenerateNinjaWithOpt(g, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		filename string
+		want     []string
+	}{
+		{
+			filename: "out/build-p.ninja",
+			want: []string{
+				"build out/build-p.ninja: regen_ninja Makefile out/.kati_stamp-p sub/a.mk\n",
+				"subninja out/subninja-p/build.ninja\nsubninja out/subninja-p/sub/build.ninja\n",
+			},
+		},
+		{
+			filename: "out/subninja-p/build.ninja",
+			want: []string{
+				"build all: phony top.o sub/a.o\n",
+				"rule rule0\n",
+				"build top.o: rule0 top.c\n",
+			},
+		},
+		{
+			filename: "out/subninja-p/sub/build.ninja",
+			want: []string{
+				"rule rule0\n",
+				"build sub/a.o: rule0 sub/a.c\n",
+			},
+		},
+		{
+			filename: "out/ninja-p.sh",
+			want:     []string{`exec ninja -f out/build-p.ninja "$@"`},
+		},
+	} {
+		b, err := ioutil.ReadFile(tc.filename)
+		if err != nil {
+			t.Errorf("%s: %v", tc.filename, err)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(string(b), want) {
+				t.Errorf("%s does not have %q\n%s", tc.filename, want, b)
+			}
+		}
+	}
+	if reason := NinjaRegenReason(opt); reason != "" {
+		t.Errorf("NinjaRegenReason(%v)=%q; want=%q", opt, reason, "")
+	}
+}
+
+func TestEscapeNinjaPath(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "foo/bar.o", want: "foo/bar.o"},
+		{in: "foo bar", want: "foo$ bar"},
+		{in: "c:/foo", want: "c$:/foo"},
+		{in: "$foo", want: "$$foo"},
+	} {
+		got := escapeNinjaPath(tc.in)
+		if got != tc.want {
+			t.Errorf("escapeNinjaPath(%q)=%q; want=%q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaDefaultAndAliases(t *testing.T) {
+	src := &DepNode{Output: "src/a b.c"}
+	obj := &DepNode{
+		Output:       "out/obj/a:b.o",
+		Cmds:         []string{"cc -c '$<' -o '$@'"},
+		Deps:         []*DepNode{src},
+		ActualInputs: []string{src.Output},
+		HasRule:      true,
+	}
+	bin := &DepNode{
+		Output:       "out/bin/prog",
+		Cmds:         []string{"cc -o $@ '$^'"},
+		Deps:         []*DepNode{obj},
+		ActualInputs: []string{obj.Output},
+		HasRule:      true,
+	}
+	dup1 := &DepNode{Output: "out/1/dup", Cmds: []string{"touch $@"}, HasRule: true}
+	dup2 := &DepNode{Output: "out/2/dup", Cmds: []string{"touch $@"}, HasRule: true}
+	all := &DepNode{
+		Output:  "all",
+		Deps:    []*DepNode{bin, dup1, dup2},
+		IsPhony: true,
+		HasRule: true,
+	}
+	check := &DepNode{Output: "check$", IsPhony: true, HasRule: true}
+	g := &DepGraph{nodes: []*DepNode{all, check}, vars: make(Vars)}
+
+	n := newNinjaGenerator(g, NinjaOpt{})
+	var buf bytes.Buffer
+	err := n.writeNinja(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"build out/obj/a$:b.o: rule1 src/a$ b.c\n",
+		"build out/bin/prog: rule0 out/obj/a$:b.o\n",
+		"build prog: phony out/bin/prog\n",
+		"build a$:b.o: phony out/obj/a$:b.o\n",
+		"\ndefault all check$$\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("build.ninja does not have %q\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "build dup:") {
+		t.Errorf("build.ninja has an ambiguous alias\n%s", got)
+	}
+}
+
+func TestNinjaCCWrapper(t *testing.T) {
+	_, cleanup := chdirTemp(t, "ninja")
+	defer cleanup()
+	err := ioutil.WriteFile("Makefile", []byte(`foo: foo.o
+	cc foo.o -o $@
+foo.o: foo.c
+	cc -O2 -c $< -o $@
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenerateNinjaWithOpt(g, NinjaOpt{
+		CCWrapper:      "ccache",
+		CCRegexp:       `^cc .*-c `,
+		RemoteJobs:     50,
+		LocalPoolDepth: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		filename string
+		want     []string
+	}{
+		{
+			filename: "build.ninja",
+			want: []string{
+				"pool local_pool\n depth = 3\n",
+				"command = ccache cc -O2 -c ${in} -o ${out}\n",
+				"build foo: rule0 foo.o\n pool = local_pool\n",
+			},
+		},
+		{
+			filename: "ninja.sh",
+			want:     []string{`exec ninja -j50 "$@"`},
+		},
+	} {
+		b, err := ioutil.ReadFile(tc.filename)
+		if err != nil {
+			t.Errorf("%s: %v", tc.filename, err)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(string(b), want) {
+				t.Errorf("%s does not have %q\n%s", tc.filename, want, b)
+			}
+		}
+	}
+}
+
+func TestNinjaTargetSpecificAttributes(t *testing.T) {
+	_, cleanup := chdirTemp(t, "ninja")
+	defer cleanup()
+	err := ioutil.WriteFile("Makefile", []byte(`all: foo.o bar.o lib.a
+foo.o: .KATI_DEPFILE := foo.dep
+foo.o: .KATI_DEPS := gcc
+foo.o: .KATI_DESCRIPTION = CC $@ (cost $$1)
+foo.o: foo.c
+	cc -MD -c $< -o $@
+bar.o: .KATI_RESTAT := 1
+bar.o: bar.c
+	cc -MD -c $< -o $@
+lib.a: .KATI_RESTAT := true
+lib.a: .KATI_RSPFILE := lib.a.rsp
+lib.a: foo.o bar.o
+	ar rcs $@ @$@.rsp
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The attributes survive the serialization of the graph.
+	err = gobLoadSaver{}.Save(g, "graph.gob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = gobLoadSaver{}.Load("graph.gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenerateNinjaWithOpt(g, NinjaOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"build foo.o: rule0 foo.c\n depfile = foo.dep\n deps = gcc\n description = CC foo.o (cost $$1)\n",
+		"build bar.o: rule0 bar.c\n depfile = bar.d\n restat = 1\n",
+		"build lib.a: rule1 foo.o bar.o\n restat = 1\n rspfile = lib.a.rsp\n rspfile_content = $in\n",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("build.ninja does not have %q\n%s", want, b)
+		}
+	}
+
+	for _, tc := range []struct {
+		mk   string
+		want string
+	}{
+		{
+			mk:   "foo.o: .KATI_DEPS := clang\nfoo.o: foo.c\n\tcc -MD -c $< -o $@\n",
+			want: `[foo.o] invalid .KATI_DEPS: "clang"`,
+		},
+		{
+			mk:   "foo.o: .KATI_DEPS := gcc\nfoo.o: foo.c\n\tcc -c $< -o $@\n",
+			want: "[foo.o] .KATI_DEPS is set without a depfile",
+		},
+		{
+			mk:   "foo.o: .KATI_RESTAT := 0\nfoo.o: foo.c\n\tcc -c $< -o $@\n",
+			want: `[foo.o] invalid .KATI_RESTAT: "0"`,
+		},
+		{
+			mk:   "foo.o: .KATI_RESTAT := false\nfoo.o: foo.c\n\tcc -c $< -o $@\n",
+			want: `[foo.o] invalid .KATI_RESTAT: "false"`,
+		},
+		{
+			mk:   "foo: .KATI_RSPFILE := foo.rsp\nfoo:\n\techo " + strings.Repeat("-DFLAG ", 15000) + "\n",
+			want: "[foo] .KATI_RSPFILE cannot be used for a command longer than 100000 bytes",
+		},
+	} {
+		err = ioutil.WriteFile("Makefile", []byte(tc.mk), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err = Load(LoadReq{Makefile: "Makefile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = GenerateNinjaWithOpt(g, NinjaOpt{})
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("GenerateNinjaWithOpt()=%v; want=%q", err, tc.want)
+		}
+	}
+}
+
+func TestNinjaShellExports(t *testing.T) {
+	dir, cleanup := chdirTemp(t, "ninja")
+	defer cleanup()
+	err := ioutil.WriteFile("Makefile", []byte(`export ZZZ := last
+export AAA := it's a $$HOME
+unexport MMM
+all:
+	echo done
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fake ninja shows its environment.
+	err = ioutil.WriteFile("ninja", []byte("#!/bin/sh\nenv\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+	os.Setenv("KATI_TEST_SECRET", "1")
+	defer os.Unsetenv("KATI_TEST_SECRET")
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		opt    NinjaOpt
+		script string
+		env    []string
+		notEnv []string
+	}{
+		{
+			script: "export AAA='it'\\''s a $HOME'\nunset MMM\nexport ZZZ=last\nexec ninja \"$@\"\n",
+			env:    []string{"AAA=it's a $HOME", "ZZZ=last", "KATI_TEST_SECRET=1"},
+		},
+		{
+			opt:    NinjaOpt{Hermetic: true, HermeticEnv: []string{"PATH", "KATI_TEST_UNSET"}},
+			script: "exec env -i \\\n  ${KATI_TEST_UNSET+\"KATI_TEST_UNSET=$KATI_TEST_UNSET\"} \\\n  ${PATH+\"PATH=$PATH\"} \\\n  AAA='it'\\''s a $HOME' \\\n  ZZZ=last \\\n  ninja \"$@\"\n",
+			env:    []string{"AAA=it's a $HOME", "ZZZ=last", "PATH=" + dir + ":" + path},
+			notEnv: []string{"KATI_TEST_SECRET=", "KATI_TEST_UNSET=", "HOME="},
+		},
+	} {
+		err = GenerateNinjaWithOpt(g, tc.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("ninja.sh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(b), tc.script) {
+			t.Errorf("ninja.sh with %v=%q; want suffix %q", tc.opt, b, tc.script)
+		}
+		out, err := exec.Command("./ninja.sh").Output()
+		if err != nil {
+			t.Errorf("ninja.sh with %v: %v", tc.opt, err)
+			continue
+		}
+		env := strings.Split(string(out), "\n")
+		for _, want := range tc.env {
+			if !contains(env, want) {
+				t.Errorf("ninja.sh with %v: no %q in\n%s", tc.opt, want, out)
+			}
+		}
+		for _, e := range env {
+			for _, prefix := range tc.notEnv {
+				if strings.HasPrefix(e, prefix) {
+					t.Errorf("ninja.sh with %v: unexpected %q", tc.opt, e)
+				}
+			}
+		}
+	}
+}
+
+func TestNinjaRegenEnv(t *testing.T) {
+	_, cleanup := chdirTemp(t, "ninja")
+	defer cleanup()
+	err := ioutil.WriteFile("Makefile", []byte(`KATI_TEST_FOO ?= default
+export KATI_TEST_FOO
+all:
+	echo $(KATI_TEST_FOO)
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fake kati shows the environment it is regenerated with.
+	err = ioutil.WriteFile("kati", []byte("#!/bin/sh\necho \"${KATI_TEST_FOO-<unset>}\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("KATI_TEST_FOO")
+	os.Setenv("KATI_TEST_FOO", "1")
+
+	g, err := Load(LoadReq{Makefile: "Makefile", EnvironmentVars: os.Environ(), TrackAccesses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenerateNinjaWithOpt(g, NinjaOpt{Args: []string{"./kati", "--ninja"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("ninja.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "export KATI_ORIG_KATI_TEST_FOO=\"${KATI_TEST_FOO+set}${KATI_TEST_FOO-unset}\"\nexport KATI_TEST_FOO=1\n"
+	if !strings.Contains(string(b), want) {
+		t.Errorf("ninja.sh does not have %q\n%s", want, b)
+	}
+
+	b, err = ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmd string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, " command = ") && strings.Contains(line, "--regen") {
+			cmd = strings.Replace(strings.TrimPrefix(line, " command = "), "$$", "$", -1)
+		}
+	}
+	if cmd == "" {
+		t.Fatalf("no regen command in build.ninja\n%s", b)
+	}
+	for _, tc := range []struct {
+		env  []string
+		want string
+	}{
+		{
+			env:  []string{"KATI_TEST_FOO=1", "KATI_ORIG_KATI_TEST_FOO=set2"},
+			want: "2\n",
+		},
+		{
+			env:  []string{"KATI_TEST_FOO=1", "KATI_ORIG_KATI_TEST_FOO=unset"},
+			want: "<unset>\n",
+		},
+		{
+			env:  []string{"KATI_TEST_FOO=1"},
+			want: "1\n",
+		},
+	} {
+		c := exec.Command("/bin/sh", "-c", cmd)
+		c.Env = append([]string{"PATH=" + os.Getenv("PATH")}, tc.env...)
+		out, err := c.Output()
+		if err != nil {
+			t.Errorf("%q with %q: %v", cmd, tc.env, err)
+			continue
+		}
+		if string(out) != tc.want {
+			t.Errorf("%q with %q=%q; want=%q", cmd, tc.env, out, tc.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Output synchronization modes of recipes, as GNU make's --output-sync.
+const (
+	// OutputSyncNone streams the output of recipes as is.
+	OutputSyncNone = "none"
+	// OutputSyncLine groups the output of recipes by lines.
+	OutputSyncLine = "line"
+	// OutputSyncTarget groups the output of recipes by targets.
+	OutputSyncTarget = "target"
+	// OutputSyncRecurse is the same as OutputSyncTarget, as kati
+	// does not run recursive makes.
+	OutputSyncRecurse = "recurse"
+)
+
+func checkOutputSync(mode string) error {
+	switch mode {
+	case OutputSyncNone, OutputSyncLine, OutputSyncTarget, OutputSyncRecurse:
+		return nil
+	}
+	return fmt.Errorf("unknown output sync mode: %q", mode)
+}
+
+var (
+	// outputMu guards the output to the console from concurrent jobs.
+	outputMu sync.Mutex
+
+	// statusLineShown is true while an updating status line is on
+	// the terminal statusOut. Guarded by outputMu.
+	statusLineShown bool
+	statusOut       io.Writer
+)
+
+// clearStatusLine erases the status line, if any, so the output of
+// jobs does not follow it. outputMu must be held.
+func clearStatusLine() {
+	if statusLineShown {
+		io.WriteString(statusOut, "\r\x1b[K")
+		statusLineShown = false
+	}
+}
+
+type lockedWriter struct {
+	w io.Writer
+}
+
+func (w lockedWriter) Write(b []byte) (int, error) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	clearStatusLine()
+	return w.w.Write(b)
+}
+
+// lineWriter writes complete lines only.
+type lineWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	i := bytes.LastIndexByte(w.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	outputMu.Lock()
+	clearStatusLine()
+	_, err := w.w.Write(w.buf[:i+1])
+	outputMu.Unlock()
+	w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	return len(b), err
+}
+
+func (w *lineWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	outputMu.Lock()
+	clearStatusLine()
+	w.w.Write(w.buf)
+	outputMu.Unlock()
+	w.buf = w.buf[:0]
+}
+
+// jobOutput is where the output of a job's recipe goes.
+type jobOutput struct {
+	stdout io.Writer
+	stderr io.Writer
+	flush  func()
+}
+
+func newJobOutput(mode string, stdout, stderr io.Writer) *jobOutput {
+	switch mode {
+	case OutputSyncLine:
+		stdout := &lineWriter{w: stdout}
+		stderr := &lineWriter{w: stderr}
+		return &jobOutput{
+			stdout: stdout,
+			stderr: stderr,
+			flush: func() {
+				stdout.flush()
+				stderr.flush()
+			},
+		}
+	case OutputSyncTarget, OutputSyncRecurse:
+		var outBuf, errBuf bytes.Buffer
+		return &jobOutput{
+			stdout: &outBuf,
+			stderr: &errBuf,
+			flush: func() {
+				if outBuf.Len() == 0 && errBuf.Len() == 0 {
+					return
+				}
+				outputMu.Lock()
+				clearStatusLine()
+				stdout.Write(outBuf.Bytes())
+				stderr.Write(errBuf.Bytes())
+				outputMu.Unlock()
+			},
+		}
+	}
+	return &jobOutput{
+		stdout: lockedWriter{w: stdout},
+		stderr: lockedWriter{w: stderr},
+		flush:  func() {},
+	}
+}
+
+// observedWriter passes the output of a job to an Observer.
+type observedWriter struct {
+	w        io.Writer
+	o        Observer
+	target   string
+	isStderr bool
+}
+
+func (w observedWriter) Write(b []byte) (int, error) {
+	w.o.JobOutput(w.target, w.isStderr, b)
+	return w.w.Write(b)
+}
+
+// observe makes the output go to o as well.
+func (out *jobOutput) observe(o Observer, target string) {
+	out.stdout = observedWriter{w: out.stdout, o: o, target: target}
+	out.stderr = observedWriter{w: out.stderr, o: o, target: target, isStderr: true}
+}
+
+// stallWatcher warns when a job has produced no output for a while.
+type stallWatcher struct {
+	target string
+	d      time.Duration
+	w      io.Writer
+	done   chan bool
+	exited chan bool
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func newStallWatcher(target string, d time.Duration, w io.Writer) *stallWatcher {
+	sw := &stallWatcher{
+		target: target,
+		d:      d,
+		w:      w,
+		done:   make(chan bool),
+		exited: make(chan bool),
+		last:   time.Now(),
+	}
+	go sw.run()
+	return sw
+}
+
+func (sw *stallWatcher) touch() {
+	sw.mu.Lock()
+	sw.last = time.Now()
+	sw.mu.Unlock()
+}
+
+func (sw *stallWatcher) run() {
+	defer close(sw.exited)
+	timer := time.NewTimer(sw.d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-sw.done:
+			return
+		case <-timer.C:
+		}
+		sw.mu.Lock()
+		last := sw.last
+		sw.mu.Unlock()
+		idle := time.Since(last)
+		if idle < sw.d {
+			timer.Reset(sw.d - idle)
+			continue
+		}
+		outputMu.Lock()
+		clearStatusLine()
+		fmt.Fprintf(sw.w, "*kati*: warning: [%s] has produced no output for %d s\n", sw.target, int(idle.Seconds()))
+		outputMu.Unlock()
+		timer.Reset(sw.d)
+	}
+}
+
+func (sw *stallWatcher) stop() {
+	close(sw.done)
+	<-sw.exited
+}
+
+type stallWatchedWriter struct {
+	w  io.Writer
+	sw *stallWatcher
+}
+
+func (w stallWatchedWriter) Write(b []byte) (int, error) {
+	w.sw.touch()
+	return w.w.Write(b)
+}
+
+// watch makes the output of the job reset the idle time of sw.
+func (out *jobOutput) watch(sw *stallWatcher) {
+	out.stdout = stallWatchedWriter{w: out.stdout, sw: sw}
+	out.stderr = stallWatchedWriter{w: out.stderr, sw: sw}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestJobOutputLine(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	a := newJobOutput(OutputSyncLine, &stdout, &stderr)
+	b := newJobOutput(OutputSyncLine, &stdout, &stderr)
+	a.stdout.Write([]byte("a1\na"))
+	b.stdout.Write([]byte("b1\n"))
+	a.stderr.Write([]byte("a err\n"))
+	a.stdout.Write([]byte("2\na"))
+	b.stdout.Write([]byte("b"))
+	b.flush()
+	a.flush()
+	if got, want := stdout.String(), "a1\nb1\na2\nba"; got != want {
+		t.Errorf("stdout=%q; want=%q", got, want)
+	}
+	if got, want := stderr.String(), "a err\n"; got != want {
+		t.Errorf("stderr=%q; want=%q", got, want)
+	}
+}
+
+func TestJobOutputTarget(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	a := newJobOutput(OutputSyncTarget, &stdout, &stderr)
+	b := newJobOutput(OutputSyncTarget, &stdout, &stderr)
+	a.stdout.Write([]byte("a1\n"))
+	b.stdout.Write([]byte("b1\n"))
+	a.stderr.Write([]byte("a err\n"))
+	a.stdout.Write([]byte("a2\n"))
+	if stdout.Len() != 0 || stderr.Len() != 0 {
+		t.Errorf("output before flush: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+	b.flush()
+	a.flush()
+	if got, want := stdout.String(), "b1\na1\na2\n"; got != want {
+		t.Errorf("stdout=%q; want=%q", got, want)
+	}
+	if got, want := stderr.String(), "a err\n"; got != want {
+		t.Errorf("stderr=%q; want=%q", got, want)
+	}
+}
+
+// TestJobOutputConcurrent checks lines of two jobs writing byte by
+// byte at once are not mixed.
+func TestJobOutputConcurrent(t *testing.T) {
+	for _, mode := range []string{OutputSyncLine, OutputSyncTarget} {
+		var stdout bytes.Buffer
+		var wg sync.WaitGroup
+		for _, name := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				out := newJobOutput(mode, &stdout, &stdout)
+				defer out.flush()
+				for i := 0; i < 100; i++ {
+					for _, c := range []byte(fmt.Sprintf("%s%s%d\n", name, name, i)) {
+						out.stdout.Write([]byte{c})
+					}
+				}
+			}(name)
+		}
+		wg.Wait()
+		lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+		if len(lines) != 200 {
+			t.Errorf("%s: %d lines; want=200", mode, len(lines))
+		}
+		next := map[byte]int{}
+		for _, line := range lines {
+			want := fmt.Sprintf("%c%c%d", line[0], line[0], next[line[0]])
+			if line != want {
+				t.Errorf("%s: line=%q; want=%q", mode, line, want)
+				break
+			}
+			next[line[0]]++
+		}
+	}
+}
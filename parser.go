@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -731,10 +732,23 @@ type mkCacheEntry struct {
 type makefileCacheT struct {
 	mu sync.Mutex
 	mk map[string]mkCacheEntry
+	// inflight are the makefiles being parsed. A channel is closed
+	// when its parse is done.
+	inflight map[string]chan struct{}
+	// sem limits the number of prefetching goroutines.
+	sem chan struct{}
+	// prefetched is the number of makefiles parsed by prefetch.
+	prefetched int
 }
 
-var makefileCache = &makefileCacheT{
-	mk: make(map[string]mkCacheEntry),
+var makefileCache = newMakefileCache()
+
+func newMakefileCache() *makefileCacheT {
+	return &makefileCacheT{
+		mk:       make(map[string]mkCacheEntry),
+		inflight: make(map[string]chan struct{}),
+		sem:      make(chan struct{}, runtime.NumCPU()),
+	}
 }
 
 func (mc *makefileCacheT) lookup(filename string) (makefile, [sha1.Size]byte, bool, error) {
@@ -754,13 +768,69 @@ func (mc *makefileCacheT) lookup(filename string) (makefile, [sha1.Size]byte, bo
 
 func (mc *makefileCacheT) parse(filename string) (makefile, [sha1.Size]byte, error) {
 	logf("parse Makefile %q", filename)
-	mk, hash, ok, err := makefileCache.lookup(filename)
-	if ok {
-		if LogFlag {
-			logf("makefile cache hit for %q", filename)
+	for {
+		mk, hash, ok, err := mc.lookup(filename)
+		if ok {
+			if LogFlag {
+				logf("makefile cache hit for %q", filename)
+			}
+			return mk, hash, err
+		}
+		mc.mu.Lock()
+		ch, busy := mc.inflight[filename]
+		if !busy {
+			mc.inflight[filename] = make(chan struct{})
+		}
+		mc.mu.Unlock()
+		if !busy {
+			break
+		}
+		// Wait for the prefetch, which may have failed.
+		<-ch
+	}
+	defer mc.done(filename)
+	return mc.parseFile(filename)
+}
+
+// prefetch parses filenames in background, so later parse of them
+// will hit the cache. Errors are ignored here, and reported by parse.
+func (mc *makefileCacheT) prefetch(filenames []string) {
+	for _, filename := range filenames {
+		filename = trimLeadingCurdir(filename)
+		if IgnoreOptionalInclude != "" && matchPattern(filename, IgnoreOptionalInclude) {
+			continue
 		}
-		return mk, hash, err
+		mc.mu.Lock()
+		_, cached := mc.mk[filename]
+		_, busy := mc.inflight[filename]
+		if !cached && !busy {
+			mc.inflight[filename] = make(chan struct{})
+		}
+		mc.mu.Unlock()
+		if cached || busy {
+			continue
+		}
+		go func(filename string) {
+			mc.sem <- struct{}{}
+			defer func() { <-mc.sem }()
+			defer mc.done(filename)
+			mc.parseFile(filename)
+			mc.mu.Lock()
+			mc.prefetched++
+			mc.mu.Unlock()
+		}(filename)
 	}
+}
+
+func (mc *makefileCacheT) done(filename string) {
+	mc.mu.Lock()
+	close(mc.inflight[filename])
+	delete(mc.inflight, filename)
+	mc.mu.Unlock()
+}
+
+func (mc *makefileCacheT) parseFile(filename string) (makefile, [sha1.Size]byte, error) {
+	var hash [sha1.Size]byte
 	if LogFlag {
 		logf("reading makefile %q", filename)
 	}
@@ -769,18 +839,18 @@ func (mc *makefileCacheT) parse(filename string) (makefile, [sha1.Size]byte, err
 		return makefile{}, hash, err
 	}
 	hash = sha1.Sum(c)
-	mk, err = parseMakefile(c, filename)
+	mk, err := parseMakefile(c, filename)
 	if err != nil {
 		return makefile{}, hash, err
 	}
-	makefileCache.mu.Lock()
-	makefileCache.mk[filename] = mkCacheEntry{
+	mc.mu.Lock()
+	mc.mk[filename] = mkCacheEntry{
 		mk:   mk,
 		hash: hash,
 		err:  err,
 		ts:   time.Now().Unix(),
 	}
-	makefileCache.mu.Unlock()
+	mc.mu.Unlock()
 	return mk, hash, err
 }
 
@@ -111,7 +111,8 @@ func wildcardGlob(pat string) ([]string, error) {
 	return filepath.Glob(pat)
 }
 
-func wildcard(w evalWriter, pat string) error {
+// wildcard writes the files matched with pat to w, and returns them.
+func wildcard(w evalWriter, pat string) ([]string, error) {
 	if UseWildcardCache {
 		// TODO(ukai): make sure it didn't chdir?
 		wildcardCache.mu.Lock()
@@ -121,12 +122,12 @@ func wildcard(w evalWriter, pat string) error {
 			for _, file := range files {
 				w.writeWordString(file)
 			}
-			return nil
+			return files, nil
 		}
 	}
 	files, err := wildcardGlob(pat)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, file := range files {
 		w.writeWordString(file)
@@ -136,12 +137,15 @@ func wildcard(w evalWriter, pat string) error {
 		wildcardCache.m[pat] = files
 		wildcardCache.mu.Unlock()
 	}
-	return nil
+	return files, nil
 }
 
 type fileInfo struct {
 	path string
 	mode os.FileMode
+	// mtime is the modification time in nanoseconds, which is
+	// recorded to check whether directories are changed.
+	mtime int64
 }
 
 type androidFindCacheT struct {
@@ -151,6 +155,14 @@ type androidFindCacheT struct {
 	files    []fileInfo
 	leaves   []fileInfo
 	scanTime time.Duration
+	// curdirMtime is the modification time of ".", which is not in
+	// files.
+	curdirMtime int64
+
+	// roots are the directories from which the emulated find
+	// commands searched.
+	rootsMu sync.Mutex
+	roots   map[string]bool
 }
 
 var (
@@ -235,8 +247,9 @@ func (c *androidFindCacheT) start(prunes, leafNames []string) {
 						}
 					}
 					filech <- fileInfo{
-						path: path,
-						mode: info.Mode(),
+						path:  path,
+						mode:  info.Mode(),
+						mtime: info.ModTime().UnixNano(),
 					}
 					for _, leaf := range leafNames {
 						if info.Name() == leaf {
@@ -310,6 +323,9 @@ func (c *androidFindCacheT) start(prunes, leafNames []string) {
 		close(c.leavesch)
 		return
 	}
+	if fi, err := curdir.Stat(); err == nil {
+		c.curdirMtime = fi.ModTime().UnixNano()
+	}
 	names, err := curdir.Readdirnames(-1)
 	if err != nil {
 		logf("readdir . failed: %v", err)
@@ -328,6 +344,91 @@ func (c *androidFindCacheT) start(prunes, leafNames []string) {
 	close(leafch)
 }
 
+// useRoot records dir as a root of an emulated find command.
+func (c *androidFindCacheT) useRoot(dir string) {
+	c.rootsMu.Lock()
+	if c.roots == nil {
+		c.roots = make(map[string]bool)
+	}
+	c.roots[dir] = true
+	c.rootsMu.Unlock()
+}
+
+// lookup returns the cached file at path.
+func (c *androidFindCacheT) lookup(path string) (fileInfo, bool) {
+	i := sort.Search(len(c.files), func(i int) bool {
+		return c.files[i].path >= path
+	})
+	if i < len(c.files) && c.files[i].path == path {
+		return c.files[i], true
+	}
+	return fileInfo{}, false
+}
+
+// dirs returns the directories under the roots of the emulated find
+// commands, with their modification times at the scan. Files are added
+// to or removed from a directory only if its modification time is
+// changed, so the outputs of the emulated find commands can be checked
+// by them. For a missing root, its nearest existing ancestor is
+// returned.
+func (c *androidFindCacheT) dirs() []stampDir {
+	c.rootsMu.Lock()
+	var roots []string
+	for root := range c.roots {
+		roots = append(roots, root)
+	}
+	c.rootsMu.Unlock()
+	if len(roots) == 0 || !c.ready() {
+		return nil
+	}
+	sort.Strings(roots)
+
+	seen := make(map[string]bool)
+	var dirs []stampDir
+	add := func(fi fileInfo) {
+		if fi.mode.IsDir() && !seen[fi.path] {
+			seen[fi.path] = true
+			dirs = append(dirs, stampDir{Path: fi.path, Mtime: fi.mtime})
+		}
+	}
+	curdir := fileInfo{path: ".", mode: os.ModeDir, mtime: c.curdirMtime}
+	for _, root := range roots {
+		if root == "." {
+			add(curdir)
+			for _, fi := range c.files {
+				add(fi)
+			}
+			break
+		}
+		// A missing root is checked by its nearest existing ancestor.
+		dir := root
+		fi, ok := c.lookup(dir)
+		for !ok && dir != "." && dir != "/" {
+			dir = filepath.Dir(dir)
+			fi, ok = c.lookup(dir)
+		}
+		switch {
+		case dir == root:
+			c.walk(root, func(_ int, fi fileInfo) error {
+				add(fi)
+				return nil
+			})
+		case ok:
+			add(fi)
+		case dir == ".":
+			add(curdir)
+		}
+	}
+	sort.Sort(stampDirByPath(dirs))
+	return dirs
+}
+
+type stampDirByPath []stampDir
+
+func (d stampDirByPath) Len() int           { return len(d) }
+func (d stampDirByPath) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d stampDirByPath) Less(i, j int) bool { return d[i].Path < d[j].Path }
+
 type fileInfoByName []fileInfo
 
 func (f fileInfoByName) Len() int      { return len(f) }
@@ -409,6 +510,7 @@ Loop:
 func (c *androidFindCacheT) findInDir(w evalWriter, dir string) {
 	dir = filepath.Clean(dir)
 	logf("android find in dir cache: %s", dir)
+	c.useRoot(dir)
 	c.walk(dir, func(_ int, fi fileInfo) error {
 		// -not -name '.*'
 		if strings.HasPrefix(filepath.Base(fi.path), ".") {
@@ -435,6 +537,7 @@ func (c *androidFindCacheT) findExtFilesUnder(w evalWriter, chdir, root, ext str
 	chdir = filepath.Clean(chdir)
 	dir := filepath.Join(chdir, root)
 	logf("android find %s in dir cache: %s %s", ext, chdir, root)
+	c.useRoot(dir)
 	// check symlinks
 	var matches []int
 	err := c.walk(dir, func(i int, fi fileInfo) error {
@@ -475,6 +578,7 @@ func (c *androidFindCacheT) findExtFilesUnder(w evalWriter, chdir, root, ext str
 // -a \! -name "*~" -print )
 func (c *androidFindCacheT) findJavaResourceFileGroup(w evalWriter, dir string) {
 	logf("android find java resource in dir cache: %s", dir)
+	c.useRoot(filepath.Clean(dir))
 	c.walk(filepath.Clean(dir), func(_ int, fi fileInfo) error {
 		// -type d -a -name ".svn" -prune
 		if fi.mode.IsDir() && filepath.Base(fi.path) == ".svn" {
@@ -508,6 +612,7 @@ func (c *androidFindCacheT) findleaves(w evalWriter, dir, name string, prunes []
 	var found []string
 	var dirs []string
 	dir = filepath.Clean(dir)
+	c.useRoot(dir)
 	topdepth := strings.Count(dir, "/")
 	dirs = append(dirs, dir)
 	for len(dirs) > 0 {
@@ -555,6 +660,10 @@ func (c *androidFindCacheT) findleaves(w evalWriter, dir, name string, prunes []
 	}
 	logf("android findleave done")
 	sort.Strings(found)
+	if PrefetchIncludesFlag {
+		// The leaves are likely to be included soon.
+		makefileCache.prefetch(found)
+	}
 	for _, f := range found {
 		w.writeWordString(f)
 	}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAndroidFindCacheDirs(t *testing.T) {
+	defer func(orig bool) { UseFindCache = orig }(UseFindCache)
+	UseFindCache = true
+	dir := func(path string, mtime int64) fileInfo {
+		return fileInfo{path: path, mode: os.ModeDir, mtime: mtime}
+	}
+	file := func(path string) fileInfo {
+		return fileInfo{path: path}
+	}
+	newCache := func() *androidFindCacheT {
+		return &androidFindCacheT{
+			files: []fileInfo{
+				dir("a", 1),
+				dir("a-b", 2),
+				file("a/Android.mk"),
+				dir("a/b", 3),
+				file("a/b/c.java"),
+				dir("b", 4),
+				dir("c", 5),
+				dir("c/d", 6),
+			},
+			curdirMtime: 7,
+		}
+	}
+
+	for _, tc := range []struct {
+		roots []string
+		want  []stampDir
+	}{
+		{
+			want: nil,
+		},
+		{
+			roots: []string{"a"},
+			want:  []stampDir{{"a", 1}, {"a/b", 3}},
+		},
+		{
+			roots: []string{"a/b", "a"},
+			want:  []stampDir{{"a", 1}, {"a/b", 3}},
+		},
+		{
+			roots: []string{"b/missing/dir", "c/d"},
+			want:  []stampDir{{"b", 4}, {"c/d", 6}},
+		},
+		{
+			roots: []string{"missing"},
+			want:  []stampDir{{".", 7}},
+		},
+		{
+			roots: []string{".", "a"},
+			want:  []stampDir{{".", 7}, {"a", 1}, {"a-b", 2}, {"a/b", 3}, {"b", 4}, {"c", 5}, {"c/d", 6}},
+		},
+	} {
+		c := newCache()
+		for _, root := range tc.roots {
+			c.useRoot(root)
+		}
+		if got := c.dirs(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("dirs() with roots %q=%v; want=%v", tc.roots, got, tc.want)
+		}
+	}
+}
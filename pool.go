@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// poolVarPrefix is the prefix of variables to declare pools, e.g.
+//
+//	.KATI_POOL.link := 4
+//
+// declares the pool "link" which runs 4 jobs at most at once. Targets
+// are assigned to a pool by a target specific variable, e.g.
+//
+//	out/foo: .KATI_POOL := link
+const poolVarPrefix = ".KATI_POOL."
+
+// reservedPools can't be declared by makefiles. console is the pool of
+// ninja for commands with the terminal, and local_pool is emitted by
+// kati for NinjaOpt.LocalPoolDepth.
+var reservedPools = map[string]bool{
+	"console":    true,
+	"local_pool": true,
+}
+
+// declaredPools returns the depths of pools declared in vars.
+func declaredPools(ev *Evaluator, vars Vars) (map[string]int, error) {
+	pools := make(map[string]int)
+	for name := range vars {
+		if !strings.HasPrefix(name, poolVarPrefix) {
+			continue
+		}
+		pool := strings.TrimPrefix(name, poolVarPrefix)
+		if reservedPools[pool] {
+			return nil, fmt.Errorf("%s: pool %q is reserved", name, pool)
+		}
+		v, err := ev.EvaluateVar(name)
+		if err != nil {
+			return nil, err
+		}
+		depth, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || depth <= 0 {
+			return nil, fmt.Errorf("invalid depth of pool %q: %q", pool, v)
+		}
+		pools[pool] = depth
+	}
+	return pools, nil
+}
+
+func sortedPoolNames(pools map[string]int) []string {
+	var names []string
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nodePool returns the name of the pool of n, which must be in pools.
+func nodePool(ctx *execContext, n *DepNode, pools map[string]int) (string, error) {
+	pool, _, err := evalTargetSpecificVar(ctx, n, ".KATI_POOL")
+	if err != nil || pool == "" {
+		return "", err
+	}
+	if _, ok := pools[pool]; !ok {
+		return "", fmt.Errorf("[%s] undeclared pool: %q", n.Output, pool)
+	}
+	return pool, nil
+}
+
+// jobPool limits the number of running jobs in a pool. It is used only
+// by the workerManager goroutine.
+type jobPool struct {
+	depth   int
+	running int
+	// delayed are the ready jobs waiting for a slot of the pool.
+	delayed []*job
+}
@@ -0,0 +1,388 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stampEnv is an environment variable recorded in the stamp.
+type stampEnv struct {
+	Name  string
+	Value string
+	Set   bool
+}
+
+// stampMakefile is a makefile recorded in the stamp.
+type stampMakefile struct {
+	Filename string
+	Exists   bool
+	// Mtime is in nanoseconds. Hash is checked only if it is changed.
+	Mtime int64
+	Hash  string
+}
+
+// stampDir is a directory recorded in the stamp.
+type stampDir struct {
+	Path string
+	// Mtime is in nanoseconds.
+	Mtime int64
+}
+
+// ninjaStamp records what kati accessed to generate build.ninja, to
+// check whether it needs to be regenerated. The stamp file is an input
+// of build.ninja, and ninja.sh touches it when the environment is
+// changed, so ninja regenerates build.ninja.
+type ninjaStamp struct {
+	// Args are the command line arguments without -regen.
+	Args      []string
+	Makefiles []stampMakefile
+	Globs     []*accessedGlob
+	Envs      []stampEnv
+	// FindDirs are the directories read by the emulated find
+	// commands.
+	FindDirs []stampDir
+	// GlobDirs are inputs of build.ninja.
+	GlobDirs []string
+}
+
+var shellVarNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func newNinjaStamp(args []string, mks []*accessedMakefile, envs []string, globs []*accessedGlob, findDirs []stampDir) *ninjaStamp {
+	st := &ninjaStamp{
+		Args:     withoutRegenFlag(args),
+		Globs:    globs,
+		FindDirs: findDirs,
+	}
+	for _, mk := range mks {
+		sm := stampMakefile{Filename: mk.Filename}
+		if mk.State == fileExists {
+			sm.Exists = true
+			sm.Hash = hex.EncodeToString(mk.Hash[:])
+			if fi, err := os.Stat(mk.Filename); err == nil {
+				sm.Mtime = fi.ModTime().UnixNano()
+			}
+		}
+		st.Makefiles = append(st.Makefiles, sm)
+	}
+	sort.Sort(byFilename(st.Makefiles))
+	for _, name := range envs {
+		// Others are not visible in the shell.
+		if !shellVarNameRE.MatchString(name) {
+			continue
+		}
+		v, ok := os.LookupEnv(name)
+		st.Envs = append(st.Envs, stampEnv{Name: name, Value: v, Set: ok})
+	}
+	st.GlobDirs = globDirs(globs)
+	return st
+}
+
+func (st *ninjaStamp) write(filename string, mtime time.Time) error {
+	b, err := json.MarshalIndent(st, "", " ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filename, b, 0644)
+	if err != nil {
+		return err
+	}
+	// The stamp must not be newer than build.ninja, or ninja would
+	// regenerate it again.
+	return os.Chtimes(filename, mtime, mtime)
+}
+
+func loadNinjaStamp(filename string) (*ninjaStamp, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	st := &ninjaStamp{}
+	err = json.Unmarshal(b, st)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// check returns why build.ninja needs to be regenerated, or "" if it
+// is up to date.
+func (st *ninjaStamp) check(args []string) string {
+	if !reflect.DeepEqual(withoutRegenFlag(args), st.Args) {
+		return "command line flags were changed"
+	}
+	for _, e := range st.Envs {
+		v, ok := os.LookupEnv(e.Name)
+		if v != e.Value || ok != e.Set {
+			return fmt.Sprintf("environment variable %s was changed", e.Name)
+		}
+	}
+	for _, mk := range st.Makefiles {
+		fi, err := os.Stat(mk.Filename)
+		if err != nil {
+			if mk.Exists {
+				return fmt.Sprintf("%s was removed", mk.Filename)
+			}
+			continue
+		}
+		if !mk.Exists {
+			return fmt.Sprintf("%s was created", mk.Filename)
+		}
+		if fi.ModTime().UnixNano() == mk.Mtime {
+			continue
+		}
+		d, err := digestFile(mk.Filename)
+		if err != nil || hex.EncodeToString(d[:]) != mk.Hash {
+			return fmt.Sprintf("%s was modified", mk.Filename)
+		}
+	}
+	for _, g := range st.Globs {
+		files, err := wildcardGlob(g.Pattern)
+		if err != nil || !equalStrings(files, g.Files) {
+			return fmt.Sprintf("wildcard(%s) was changed", g.Pattern)
+		}
+	}
+	for _, d := range st.FindDirs {
+		fi, err := os.Stat(d.Path)
+		if err != nil || fi.ModTime().UnixNano() != d.Mtime {
+			return fmt.Sprintf("directory %s was changed", d.Path)
+		}
+	}
+	return ""
+}
+
+// NinjaRegenReason returns why build.ninja generated with opt needs to
+// be regenerated, or "" if it is up to date.
+func NinjaRegenReason(opt NinjaOpt) string {
+	for _, filename := range []string{opt.ninjaFile(), opt.shellFile()} {
+		if !exists(filename) {
+			return fmt.Sprintf("%s does not exist", filename)
+		}
+	}
+	st, err := loadNinjaStamp(opt.stampFile())
+	if err != nil {
+		return fmt.Sprintf("failed to load %s: %v", opt.stampFile(), err)
+	}
+	return st.check(opt.Args)
+}
+
+type byFilename []stampMakefile
+
+func (p byFilename) Len() int           { return len(p) }
+func (p byFilename) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byFilename) Less(i, j int) bool { return p[i].Filename < p[j].Filename }
+
+func isRegenFlag(arg string) bool {
+	arg = strings.TrimLeft(arg, "-")
+	return arg == "regen" || strings.HasPrefix(arg, "regen=")
+}
+
+func withoutRegenFlag(args []string) []string {
+	var r []string
+	for _, arg := range args {
+		if !isRegenFlag(arg) {
+			r = append(r, arg)
+		}
+	}
+	return r
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeEnvCheck writes shell commands to touch the stamp if the
+// environment variables are changed.
+func (st *ninjaStamp) writeEnvCheck(w io.Writer, stampFile string) {
+	if len(st.Envs) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# Regenerate build.ninja if the environment is changed.\n")
+	for _, e := range st.Envs {
+		want := "''"
+		if e.Set {
+			want = shellQuote("set" + e.Value)
+		}
+		fmt.Fprintf(w, "[ \"${%s+set}${%s-}\" = %s ] || touch %s\n", e.Name, e.Name, want, shellQuote(stampFile))
+	}
+}
+
+// globDirs returns the existing directories which are read by globs.
+// The current directory is not included, as its modification time
+// changes whenever a file is created there, e.g. ninja's log. Globs in
+// it are checked by --regen.
+func globDirs(globs []*accessedGlob) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		dir = filepath.Clean(dir)
+		if dir == "." || seen[dir] {
+			return
+		}
+		seen[dir] = true
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, g := range globs {
+		pat := g.Pattern
+		if i := strings.IndexAny(pat, "*?["); i >= 0 {
+			pat = pat[:i]
+		}
+		add(filepath.Dir(pat))
+		for _, f := range g.Files {
+			add(filepath.Dir(f))
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// existingDir returns the nearest existing ancestor directory of
+// filename, whose modification time changes when filename is created.
+func existingDir(filename string) string {
+	dir := filepath.Dir(filename)
+	for dir != "." && dir != "/" {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// shellQuote quotes s for the shell, if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=./:,@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// regenInputs returns the inputs of build.ninja.
+func (n *ninjaGenerator) regenInputs() []string {
+	seen := make(map[string]bool)
+	var inputs []string
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			inputs = append(inputs, s)
+		}
+	}
+	for _, mk := range n.accessedMks {
+		switch mk.State {
+		case fileExists:
+			add(mk.Filename)
+		case fileNotExists:
+			// As in globDirs, a makefile missing in the current
+			// directory is checked only by --regen.
+			if dir := existingDir(mk.Filename); dir != "." {
+				add(dir)
+			}
+		}
+	}
+	for _, dir := range n.stamp.GlobDirs {
+		add(dir)
+	}
+	add(n.opt.stampFile())
+	sort.Strings(inputs)
+	return inputs
+}
+
+// origEnvName is the variable in which ninja.sh saves the value of
+// name before the exports: "set<value>" if name is set, or "unset".
+func origEnvName(name string) string {
+	return "KATI_ORIG_" + name
+}
+
+// origEnvValue is the shell word to save the value of name.
+func origEnvValue(name string) string {
+	return fmt.Sprintf(`"${%s+set}${%s-unset}"`, name, name)
+}
+
+// regenCommand returns the command to run kati again, with the
+// environment variables restored from the values saved by ninja.sh
+// before the exports.
+func (n *ninjaGenerator) regenCommand() string {
+	var restore []string
+	for _, name := range sortedExports(n.exports) {
+		if !shellVarNameRE.MatchString(name) {
+			continue
+		}
+		orig := origEnvName(name)
+		restore = append(restore, fmt.Sprintf(`case "${%s-}" in set*) export %s="${%s#set}";; unset) unset %s;; esac; `, orig, name, orig, name))
+	}
+	// The regeneration is skipped if nothing is changed.
+	var args []string
+	for i, arg := range withoutRegenFlag(n.opt.Args) {
+		args = append(args, shellQuote(arg))
+		if i == 0 {
+			args = append(args, "--regen")
+		}
+	}
+	cmd := strings.Join(restore, "") + strings.Join(args, " ")
+	return strings.Replace(cmd, "$", "$$", -1)
+}
+
+func (n *ninjaGenerator) emitRegenRule() {
+	fmt.Fprintf(n.w, "\nrule regen_ninja\n")
+	fmt.Fprintf(n.w, " description = Regenerating $out\n")
+	fmt.Fprintf(n.w, " command = %s\n", n.regenCommand())
+	fmt.Fprintf(n.w, " generator = 1\n")
+	fmt.Fprintf(n.w, " restat = 1\n")
+	fmt.Fprintf(n.w, "build %s: regen_ninja %s\n", escapeNinjaPath(n.opt.ninjaFile()), escapeNinjaPaths(n.regenInputs()))
+	fmt.Fprintf(n.w, " pool = console\n")
+	fmt.Fprintf(n.w, "\n")
+}
+
+// sortedUniq sorts ss and removes duplicates.
+func sortedUniq(ss []string) []string {
+	sort.Strings(ss)
+	var r []string
+	for i, s := range ss {
+		if i == 0 || s != ss[i-1] {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+func sortedExports(exports map[string]bool) []string {
+	var names []string
+	for name := range exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
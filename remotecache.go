@@ -0,0 +1,356 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteCache is an outputCache on an HTTP server which speaks the
+// protocol of the Bazel HTTP cache, e.g. bazel-remote, i.e. GET and PUT
+// on <url>/ac/<key> and <url>/cas/<sha256>. The action entries are
+// ActionResult protobufs of the remote execution API, which have the
+// output as an output file.
+//
+// The timeout applies to connecting and waiting for a response, not to
+// transferring bodies, so large outputs can be stored on a slow link.
+// Once the server is unreachable, the cache is disabled for the rest
+// of the build, so jobs run locally without waiting for timeouts.
+type remoteCache struct {
+	url    string
+	client *http.Client
+	// stderr is where the warning is written when the cache is
+	// disabled.
+	stderr io.Writer
+
+	mu       sync.Mutex
+	disabled bool
+}
+
+func newRemoteCache(url string, timeout time.Duration, stderr io.Writer) *remoteCache {
+	return &remoteCache{
+		url:    strings.TrimSuffix(url, "/"),
+		stderr: stderr,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				Dial:                  (&net.Dialer{Timeout: timeout}).Dial,
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+			},
+		},
+	}
+}
+
+func (c *remoteCache) isDisabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.disabled
+}
+
+// fail disables the cache on an error of the connection.
+func (c *remoteCache) fail(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.disabled {
+		c.disabled = true
+		outputMu.Lock()
+		clearStatusLine()
+		fmt.Fprintf(c.stderr, "*kati*: warning: remote cache %s is disabled: %v\n", c.url, err)
+		outputMu.Unlock()
+	}
+	return err
+}
+
+// fetch writes the contents of path to w, and reports whether it was
+// found.
+func (c *remoteCache) fetch(path string, w io.Writer) (bool, error) {
+	resp, err := c.client.Get(c.url + path)
+	if err != nil {
+		return false, c.fail(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("GET %s%s: %s", c.url, path, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return false, c.fail(err)
+	}
+	return true, nil
+}
+
+func (c *remoteCache) store(path string, body io.Reader, size int64) error {
+	req, err := http.NewRequest("PUT", c.url+path, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s%s: %s", c.url, path, resp.Status)
+	}
+	return nil
+}
+
+func (c *remoteCache) get(key, output string) (bool, error) {
+	if c.isDisabled() {
+		return false, nil
+	}
+	var entry bytes.Buffer
+	found, err := c.fetch("/ac/"+key, &entry)
+	if !found || err != nil {
+		return false, err
+	}
+	of, err := parseActionResult(entry.Bytes(), output)
+	if err != nil {
+		return false, err
+	}
+	mode := os.FileMode(0644)
+	if of.executable {
+		mode = 0755
+	}
+
+	dir := filepath.Dir(output)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return false, err
+	}
+	f, err := ioutil.TempFile(dir, ".kati_tmp")
+	if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	found, err = c.fetch("/cas/"+of.digest, io.MultiWriter(f, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if found && err == nil {
+		if digest := hex.EncodeToString(h.Sum(nil)); digest != of.digest {
+			err = fmt.Errorf("GET %s/cas/%s: broken contents: sha256 %s", c.url, of.digest, digest)
+		}
+	}
+	if found && err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if found && err == nil {
+		err = os.Rename(f.Name(), output)
+	}
+	if !found || err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *remoteCache) put(key, output string) error {
+	if c.isDisabled() {
+		return nil
+	}
+	digest, mode, err := casDigest(output)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = c.store("/cas/"+digest, f, fi.Size())
+	if err != nil {
+		return err
+	}
+	entry := encodeActionResult(outputFile{
+		path:       output,
+		digest:     digest,
+		size:       fi.Size(),
+		executable: mode&0111 != 0,
+	})
+	return c.store("/ac/"+key, bytes.NewReader(entry), int64(len(entry)))
+}
+
+// outputFile is an OutputFile message of the remote execution API.
+type outputFile struct {
+	path       string
+	digest     string
+	size       int64
+	executable bool
+}
+
+// Field numbers of the messages of the remote execution API
+// (build.bazel.remote.execution.v2).
+const (
+	actionResultOutputFiles = 2
+
+	outputFilePath         = 1
+	outputFileDigest       = 2
+	outputFileIsExecutable = 4
+
+	digestHash      = 1
+	digestSizeBytes = 2
+)
+
+// Wire types of protobuf.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(field<<3|protoVarint))]...)
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(field<<3|protoBytes))]...)
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(v)))]...)
+	return append(b, v...)
+}
+
+// encodeActionResult returns an ActionResult protobuf which has of as
+// the only output file.
+func encodeActionResult(of outputFile) []byte {
+	digest := appendProtoBytes(nil, digestHash, []byte(of.digest))
+	digest = appendProtoVarint(digest, digestSizeBytes, uint64(of.size))
+	f := appendProtoBytes(nil, outputFilePath, []byte(of.path))
+	f = appendProtoBytes(f, outputFileDigest, digest)
+	if of.executable {
+		f = appendProtoVarint(f, outputFileIsExecutable, 1)
+	}
+	return appendProtoBytes(nil, actionResultOutputFiles, f)
+}
+
+// parseProto calls fn for each field of the protobuf message b. v is
+// the value of a varint field, and data is the contents of a length
+// delimited field.
+func parseProto(b []byte, fn func(field, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("broken protobuf: bad key")
+		}
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wire {
+		case protoVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("broken protobuf: bad varint")
+			}
+			b = b[n:]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if wire == protoFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return errors.New("broken protobuf: short fixed field")
+			}
+			b = b[size:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("broken protobuf: bad length")
+			}
+			data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return fmt.Errorf("broken protobuf: wire type %d", wire)
+		}
+		err := fn(field, wire, v, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseActionResult returns the output file for path in the
+// ActionResult protobuf b.
+func parseActionResult(b []byte, path string) (outputFile, error) {
+	var found *outputFile
+	err := parseProto(b, func(field, wire int, _ uint64, data []byte) error {
+		if field != actionResultOutputFiles || wire != protoBytes {
+			return nil
+		}
+		var of outputFile
+		err := parseProto(data, func(field, wire int, v uint64, data []byte) error {
+			switch {
+			case field == outputFilePath && wire == protoBytes:
+				of.path = string(data)
+			case field == outputFileIsExecutable && wire == protoVarint:
+				of.executable = v != 0
+			case field == outputFileDigest && wire == protoBytes:
+				return parseProto(data, func(field, wire int, v uint64, data []byte) error {
+					switch {
+					case field == digestHash && wire == protoBytes:
+						of.digest = string(data)
+					case field == digestSizeBytes && wire == protoVarint:
+						of.size = int64(v)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if of.path == path && found == nil {
+			found = &of
+		}
+		return nil
+	})
+	if err != nil {
+		return outputFile{}, err
+	}
+	if found == nil || found.digest == "" {
+		return outputFile{}, fmt.Errorf("no output file %q in action result", path)
+	}
+	return *found, nil
+}
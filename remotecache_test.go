@@ -0,0 +1,234 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCacheServer is an in-memory HTTP cache.
+type fakeCacheServer struct {
+	mu   sync.Mutex
+	blob map[string][]byte
+}
+
+func (s *fakeCacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/ac/") && !strings.HasPrefix(r.URL.Path, "/cas/") {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case "GET":
+		b, ok := s.blob[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	case "PUT":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.blob[r.URL.Path] = b
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out", "foo")
+	err = os.MkdirAll(filepath.Dir(output), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(output, []byte("obj"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &fakeCacheServer{blob: make(map[string][]byte)}
+	server := httptest.NewServer(fs)
+	var stderr bytes.Buffer
+	rc := newRemoteCache(server.URL+"/", time.Second, &stderr)
+	hit, err := rc.get("key", output)
+	if hit || err != nil {
+		t.Errorf("get(key)=%t, %v; want=false, <nil>", hit, err)
+	}
+	err = rc.put("key", output)
+	if err != nil {
+		t.Fatalf("put(key)=%v", err)
+	}
+	digest, _, _ := casDigest(output)
+	if got := string(fs.blob["/cas/"+digest]); got != "obj" {
+		t.Errorf("/cas/%s=%q; want=%q", digest, got, "obj")
+	}
+
+	// Another developer has an empty local cache.
+	os.RemoveAll(filepath.Dir(output))
+	ac, err := newActionCache(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := tieredCache{ac, rc}
+	hit, err = c.get("key", output)
+	if !hit || err != nil {
+		t.Fatalf("get(key)=%t, %v; want=true, <nil>", hit, err)
+	}
+	b, err := ioutil.ReadFile(output)
+	if err != nil || string(b) != "obj" {
+		t.Errorf("restored %s=%q, %v; want=%q", output, b, err, "obj")
+	}
+	if fi, err := os.Stat(output); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("mode of restored %s=%v, %v; want=%v", output, fi.Mode().Perm(), err, os.FileMode(0755))
+	}
+	if hit, _ := ac.get("key", output); !hit {
+		t.Errorf("local get(key)=false after remote hit; want=true")
+	}
+
+	// Fall back to local execution when the server goes away.
+	server.Close()
+	hit, err = rc.get("other", output)
+	if hit || err == nil {
+		t.Errorf("get(other)=%t, %v after the server is closed; want=false, error", hit, err)
+	}
+	if !rc.isDisabled() {
+		t.Errorf("remote cache is not disabled after a connection error")
+	}
+	if !strings.Contains(stderr.String(), "remote cache "+server.URL+" is disabled") {
+		t.Errorf("stderr=%q; want the disabled warning", stderr.String())
+	}
+	hit, err = rc.get("other", output)
+	if hit || err != nil {
+		t.Errorf("get(other)=%t, %v on disabled cache; want=false, <nil>", hit, err)
+	}
+}
+
+// slowReader returns one byte per read after a delay.
+type slowReader struct {
+	n     int
+	delay time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	r.n--
+	b[0] = 'x'
+	return 1, nil
+}
+
+func TestRemoteCacheSlowUpload(t *testing.T) {
+	fs := &fakeCacheServer{blob: make(map[string][]byte)}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+	rc := newRemoteCache(server.URL, 50*time.Millisecond, ioutil.Discard)
+	// The upload takes longer than the timeout.
+	err := rc.store("/cas/slow", &slowReader{n: 4, delay: 30 * time.Millisecond}, 4)
+	if err != nil {
+		t.Errorf("store(/cas/slow)=%v; want=<nil>", err)
+	}
+	if rc.isDisabled() {
+		t.Errorf("remote cache is disabled by a slow upload")
+	}
+	if got := string(fs.blob["/cas/slow"]); got != "xxxx" {
+		t.Errorf("/cas/slow=%q; want=%q", got, "xxxx")
+	}
+}
+
+func TestRemoteCacheBrokenCAS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "foo")
+	err = ioutil.WriteFile(output, []byte("obj"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &fakeCacheServer{blob: make(map[string][]byte)}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+	rc := newRemoteCache(server.URL, time.Second, ioutil.Discard)
+	err = rc.put("key", output)
+	if err != nil {
+		t.Fatalf("put(key)=%v", err)
+	}
+	digest, _, _ := casDigest(output)
+	fs.blob["/cas/"+digest] = []byte("bad")
+
+	os.Remove(output)
+	hit, err := rc.get("key", output)
+	if hit || err == nil {
+		t.Errorf("get(key)=%t, %v with broken CAS; want=false, error", hit, err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("%s exists after broken CAS: %v", output, err)
+	}
+}
+
+func TestActionResult(t *testing.T) {
+	of := outputFile{path: "a", digest: "d", size: 3, executable: true}
+	want := []byte{
+		0x12, 0x0c, // output_files
+		0x0a, 0x01, 'a', // path
+		0x12, 0x05, // digest
+		0x0a, 0x01, 'd', // hash
+		0x10, 0x03, // size_bytes
+		0x20, 0x01, // is_executable
+	}
+	b := encodeActionResult(of)
+	if !bytes.Equal(b, want) {
+		t.Errorf("encodeActionResult(%v)=% x; want=% x", of, b, want)
+	}
+
+	// Unknown fields, e.g. exit_code and execution_metadata, are skipped.
+	b = append(appendProtoVarint(nil, 4, 0), b...)
+	b = appendProtoBytes(b, 9, []byte("meta"))
+	got, err := parseActionResult(b, "a")
+	if err != nil || got != of {
+		t.Errorf("parseActionResult(%q)=%v, %v; want=%v, <nil>", "a", got, err, of)
+	}
+	_, err = parseActionResult(b, "b")
+	if err == nil {
+		t.Errorf("parseActionResult(%q)=_, <nil>; want=error", "b")
+	}
+	_, err = parseActionResult([]byte{0x12, 0x20}, "a")
+	if err == nil {
+		t.Errorf("parseActionResult(truncated)=_, <nil>; want=error")
+	}
+}
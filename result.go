@@ -0,0 +1,62 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import "time"
+
+// Observer receives the progress of jobs from Executor. Methods may be
+// called concurrently from jobs running in parallel.
+type Observer interface {
+	// JobStarted is called when a job starts running its recipe.
+	JobStarted(target string)
+
+	// JobOutput is called with a chunk of the output of the recipe.
+	// b must not be retained after the call.
+	JobOutput(target string, isStderr bool, b []byte)
+
+	// JobFinished is called when a job which ran its recipe, or
+	// restored its output from the cache, finishes, or when a job
+	// fails. exit is the exit status of the failed command.
+	JobFinished(target string, d time.Duration, exit int)
+
+	// JobSkipped is called when a target is up to date.
+	JobSkipped(target string)
+}
+
+// TargetStatus is how a target ended in a build.
+type TargetStatus string
+
+// Statuses of targets.
+const (
+	TargetBuilt    TargetStatus = "built"
+	TargetUpToDate TargetStatus = "up_to_date"
+	TargetCached   TargetStatus = "cached"
+	TargetFailed   TargetStatus = "failed"
+)
+
+// TargetResult is the result of a target with a rule.
+type TargetResult struct {
+	Target   string
+	Status   TargetStatus
+	Duration time.Duration
+	// Exit is the exit status of the failed command.
+	Exit int
+}
+
+// BuildResult is the result of Executor.ExecContext.
+type BuildResult struct {
+	// Targets are in the order of their starts.
+	Targets []TargetResult
+}
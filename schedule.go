@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timingLog keeps the duration of the last run of each output. It is
+// used to weight jobs by their critical path.
+type timingLog struct {
+	mu        sync.Mutex
+	filename  string
+	durations map[string]time.Duration
+}
+
+// loadTimingLog reads filename. A missing file is not an error, the
+// log will simply be empty.
+func loadTimingLog(filename string) (*timingLog, error) {
+	tl := &timingLog{
+		filename:  filename,
+		durations: make(map[string]time.Duration),
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return tl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := s.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		// <duration in ms>\t<output>
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			return nil, fmt.Errorf("%s:%d: broken timing log entry %q", filename, lineno, line)
+		}
+		ms, err := strconv.ParseInt(line[:tab], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		tl.durations[line[tab+1:]] = time.Duration(ms) * time.Millisecond
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	logStats("timing log: %d entries", len(tl.durations))
+	return tl, nil
+}
+
+func (tl *timingLog) lookup(output string) (time.Duration, bool) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	d, ok := tl.durations[output]
+	return d, ok
+}
+
+func (tl *timingLog) record(output string, d time.Duration) {
+	tl.mu.Lock()
+	tl.durations[output] = d
+	tl.mu.Unlock()
+}
+
+// average returns the average duration of all entries, or zero if the
+// log is empty.
+func (tl *timingLog) average() time.Duration {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if len(tl.durations) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range tl.durations {
+		total += d
+	}
+	return total / time.Duration(len(tl.durations))
+}
+
+func (tl *timingLog) save() (err error) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	var outputs []string
+	for o := range tl.durations {
+		outputs = append(outputs, o)
+	}
+	sort.Strings(outputs)
+
+	tmp := tl.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# kati timing log\n")
+	for _, o := range outputs {
+		fmt.Fprintf(w, "%d\t%s\n", tl.durations[o]/time.Millisecond, o)
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, tl.filename)
+}
+
+// criticalPath computes the priority of each node, which is the
+// expected time to finish the longest path from the node to a root of
+// the graph (i.e. through its Parents). The cost of a node is its
+// duration in the timing log. Nodes without history cost the average
+// of the known durations, or one unit when the log is empty, so
+// without any history the priority is the depth of the node.
+type criticalPath struct {
+	tl      *timingLog
+	unknown int64
+	prio    map[*DepNode]int64
+}
+
+func newCriticalPath(tl *timingLog) *criticalPath {
+	unknown := int64(tl.average())
+	if unknown <= 0 {
+		unknown = 1
+	}
+	return &criticalPath{
+		tl:      tl,
+		unknown: unknown,
+		prio:    make(map[*DepNode]int64),
+	}
+}
+
+func (cp *criticalPath) cost(n *DepNode) int64 {
+	if !n.HasRule || len(n.Cmds) == 0 {
+		return 0
+	}
+	if d, ok := cp.tl.lookup(n.Output); ok {
+		// Even a very fast step makes the path one step longer.
+		return int64(d) + 1
+	}
+	return cp.unknown
+}
+
+func (cp *criticalPath) priority(n *DepNode) int64 {
+	if p, ok := cp.prio[n]; ok {
+		if p < 0 {
+			// Circular dependency. It will be dropped by makeJobs.
+			return 0
+		}
+		return p
+	}
+	cp.prio[n] = -1
+	var longest int64
+	for _, p := range n.Parents {
+		if pp := cp.priority(p); pp > longest {
+			longest = pp
+		}
+	}
+	p := cp.cost(n) + longest
+	cp.prio[n] = p
+	return p
+}
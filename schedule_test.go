@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCriticalPathPriority(t *testing.T) {
+	// all <- link <- {a.o, b.o}, all <- stamp
+	all := &DepNode{Output: "all", HasRule: true, IsPhony: true}
+	link := &DepNode{Output: "link", HasRule: true, Cmds: []string{"ld"}, Parents: []*DepNode{all}}
+	stamp := &DepNode{Output: "stamp", HasRule: true, Cmds: []string{"touch"}, Parents: []*DepNode{all}}
+	a := &DepNode{Output: "a.o", HasRule: true, Cmds: []string{"cc"}, Parents: []*DepNode{link}}
+	b := &DepNode{Output: "b.o", HasRule: true, Cmds: []string{"cc"}, Parents: []*DepNode{link}}
+
+	tl := &timingLog{durations: make(map[string]time.Duration)}
+	cp := newCriticalPath(tl)
+	// Without history, the priority is the depth.
+	for _, tc := range []struct {
+		n    *DepNode
+		want int64
+	}{
+		{all, 0},
+		{link, 1},
+		{stamp, 1},
+		{a, 2},
+		{b, 2},
+	} {
+		if got := cp.priority(tc.n); got != tc.want {
+			t.Errorf("priority(%s)=%d; want=%d", tc.n.Output, got, tc.want)
+		}
+	}
+
+	tl.record("link", 10*time.Second)
+	tl.record("stamp", time.Second)
+	tl.record("a.o", time.Second)
+	tl.record("b.o", 3*time.Second)
+	cp = newCriticalPath(tl)
+	if got, other := cp.priority(a), cp.priority(stamp); got <= other {
+		t.Errorf("priority(a.o)=%d <= priority(stamp)=%d", got, other)
+	}
+	if got, other := cp.priority(b), cp.priority(a); got <= other {
+		t.Errorf("priority(b.o)=%d <= priority(a.o)=%d", got, other)
+	}
+}
+
+func TestTimingLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timinglog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "log")
+
+	tl, err := loadTimingLog(filename)
+	if err != nil {
+		t.Fatalf("loadTimingLog(%q)=_, %v", filename, err)
+	}
+	tl.record("out/foo bar.o", 1500*time.Millisecond)
+	tl.record("out/baz", 2*time.Millisecond)
+	err = tl.save()
+	if err != nil {
+		t.Fatalf("save()=%v", err)
+	}
+
+	tl, err = loadTimingLog(filename)
+	if err != nil {
+		t.Fatalf("loadTimingLog(%q)=_, %v", filename, err)
+	}
+	for output, want := range map[string]time.Duration{
+		"out/foo bar.o": 1500 * time.Millisecond,
+		"out/baz":       2 * time.Millisecond,
+	} {
+		got, ok := tl.lookup(output)
+		if !ok || got != want {
+			t.Errorf("lookup(%q)=%v, %t; want=%v, true", output, got, ok, want)
+		}
+	}
+}
@@ -117,6 +117,7 @@ type serializableDepNode struct {
 	Parents            []int
 	HasRule            bool
 	IsPhony            bool
+	IsCacheable        bool
 	ActualInputs       []int
 	TargetSpecificVars []int
 	Filename           string
@@ -129,13 +130,17 @@ type serializableTargetSpecificVar struct {
 }
 
 type serializableGraph struct {
-	Nodes       []*serializableDepNode
-	Vars        map[string]serializableVar
-	Tsvs        []serializableTargetSpecificVar
-	Targets     []string
-	Roots       []string
-	AccessedMks []*accessedMakefile
-	Exports     map[string]bool
+	Nodes         []*serializableDepNode
+	Vars          map[string]serializableVar
+	Tsvs          []serializableTargetSpecificVar
+	Targets       []string
+	Roots         []string
+	AccessedMks   []*accessedMakefile
+	AccessedGlobs []*accessedGlob
+	AccessedFinds []*accessedFind
+	UsedEnvs      []string
+	Exports       map[string]bool
+	Cycles        []string
 }
 
 func encGob(v interface{}) (string, error) {
@@ -245,6 +250,7 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 			Parents:            parents,
 			HasRule:            n.HasRule,
 			IsPhony:            n.IsPhony,
+			IsCacheable:        n.IsCacheable,
 			ActualInputs:       actualInputs,
 			TargetSpecificVars: vars,
 			Filename:           n.Filename,
@@ -274,13 +280,17 @@ func makeSerializableGraph(g *DepGraph, roots []string) (serializableGraph, erro
 	ns.serializeDepNodes(g.nodes)
 	v := makeSerializableVars(g.vars)
 	return serializableGraph{
-		Nodes:       ns.nodes,
-		Vars:        v,
-		Tsvs:        ns.tsvs,
-		Targets:     ns.targets,
-		Roots:       roots,
-		AccessedMks: g.accessedMks,
-		Exports:     g.exports,
+		Nodes:         ns.nodes,
+		Vars:          v,
+		Tsvs:          ns.tsvs,
+		Targets:       ns.targets,
+		Roots:         roots,
+		AccessedMks:   g.accessedMks,
+		AccessedGlobs: g.accessedGlobs,
+		AccessedFinds: g.accessedFinds,
+		UsedEnvs:      g.usedEnvs,
+		Exports:       g.exports,
+		Cycles:        g.cycles,
 	}, ns.err
 }
 
@@ -535,6 +545,7 @@ func deserializeNodes(g serializableGraph) (r []*DepNode, err error) {
 			Cmds:               n.Cmds,
 			HasRule:            n.HasRule,
 			IsPhony:            n.IsPhony,
+			IsCacheable:        n.IsCacheable,
 			ActualInputs:       actualInputs,
 			Filename:           n.Filename,
 			Lineno:             n.Lineno,
@@ -698,10 +709,14 @@ func deserializeGraph(g serializableGraph) (*DepGraph, error) {
 		return nil, err
 	}
 	return &DepGraph{
-		nodes:       nodes,
-		vars:        vars,
-		accessedMks: g.AccessedMks,
-		exports:     g.Exports,
+		nodes:         nodes,
+		vars:          vars,
+		accessedMks:   g.AccessedMks,
+		accessedGlobs: g.AccessedGlobs,
+		accessedFinds: g.AccessedFinds,
+		usedEnvs:      g.UsedEnvs,
+		exports:       g.Exports,
+		cycles:        g.Cycles,
 	}, nil
 }
 
@@ -15,6 +15,7 @@
 package kati
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 	"time"
@@ -289,8 +290,9 @@ func (f *funcShellAndroidFindFileInDir) Eval(w evalWriter, ev *Evaluator) error
 		logf("shellAndroidFindFileInDir androidFindCache is not ready: call original shell")
 		return f.funcShell.Eval(w, ev)
 	}
-	androidFindCache.findInDir(w, dir)
-	return nil
+	return f.findWithCache(w, ev, func(w evalWriter) {
+		androidFindCache.findInDir(w, dir)
+	})
 }
 
 type funcShellAndroidFindExtFilesUnder struct {
@@ -341,8 +343,9 @@ func (f *funcShellAndroidFindExtFilesUnder) Eval(w evalWriter, ev *Evaluator) er
 		}
 	}
 	w.Write(buf.Bytes())
+	err = f.recordFind(ev, buf.Bytes())
 	buf.release()
-	return nil
+	return err
 }
 
 type funcShellAndroidFindJavaResourceFileGroup struct {
@@ -367,8 +370,9 @@ func (f *funcShellAndroidFindJavaResourceFileGroup) Eval(w evalWriter, ev *Evalu
 		logf("shellAndroidFindJavaResourceFileGroup androidFindCache is not ready: call original shell")
 		return f.funcShell.Eval(w, ev)
 	}
-	androidFindCache.findJavaResourceFileGroup(w, dir)
-	return nil
+	return f.findWithCache(w, ev, func(w evalWriter) {
+		androidFindCache.findJavaResourceFileGroup(w, dir)
+	})
 }
 
 type funcShellAndroidFindleaves struct {
@@ -415,9 +419,43 @@ func (f *funcShellAndroidFindleaves) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	wb.release()
 
-	for _, dir := range dirs {
-		androidFindCache.findleaves(w, dir, name, prunes, f.mindepth)
+	return f.findWithCache(w, ev, func(w evalWriter) {
+		for _, dir := range dirs {
+			androidFindCache.findleaves(w, dir, name, prunes, f.mindepth)
+		}
+	})
+}
+
+// findWithCache writes the output of find to w, and records it for
+// regeneration.
+func (f *funcShell) findWithCache(w evalWriter, ev *Evaluator, find func(evalWriter)) error {
+	if ev.cache == nil {
+		find(w)
+		return nil
+	}
+	wb := newWbuf()
+	find(wb)
+	for _, word := range wb.words {
+		w.writeWord(word)
+	}
+	err := f.recordFind(ev, bytes.Join(wb.words, []byte{' '}))
+	wb.release()
+	return err
+}
+
+// recordFind records out as the output of the shell command of f, which
+// is emulated with the find cache.
+func (f *funcShell) recordFind(ev *Evaluator, out []byte) error {
+	if ev.cache == nil {
+		return nil
 	}
+	buf := newEbuf()
+	err := f.args[1].Eval(buf, ev)
+	if err != nil {
+		return err
+	}
+	ev.cache.addFind(buf.String(), string(out))
+	buf.release()
 	return nil
 }
 
@@ -15,6 +15,7 @@
 package kati
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -35,6 +36,8 @@ const (
 	traceEventFindCache
 	traceEventFindCacheLeaves
 	traceEventFindCacheFiles
+	// Jobs run by the worker N have the tid traceEventWorker+N.
+	traceEventWorker
 )
 
 var traceEvent traceEventT
@@ -69,6 +72,8 @@ type event struct {
 	tid     int
 	t       time.Time
 	emit    bool
+	// args are marshaled to JSON for the end of the event.
+	args map[string]interface{}
 }
 
 func (t *traceEventT) begin(name string, v Value, tid int) event {
@@ -80,7 +85,10 @@ func (t *traceEventT) begin(name string, v Value, tid int) event {
 		e.v = v.String()
 	}
 	if t.f != nil {
-		e.emit = name == "include" || name == "shell" || name == "findcache"
+		switch name {
+		case "include", "shell", "findcache", "build", "run":
+			e.emit = true
+		}
 		if e.emit {
 			t.emit("B", e, e.t.Sub(t.t0))
 		}
@@ -97,13 +105,23 @@ func (t *traceEventT) emit(ph string, e event, ts time.Duration) {
 	} else {
 		fmt.Fprintf(t.f, ",\n")
 	}
-	fmt.Fprintf(t.f, `{"pid":%d,"tid":%d,"ts":%d,"ph":%q,"cat":%q,"name":%q,"args":{}}`,
+	// %q is not JSON escaping for control and non-ASCII characters,
+	// which may be in commands and targets.
+	name, _ := json.Marshal(e.v)
+	args := []byte("{}")
+	if ph == "E" && e.args != nil {
+		if b, err := json.Marshal(e.args); err == nil {
+			args = b
+		}
+	}
+	fmt.Fprintf(t.f, `{"pid":%d,"tid":%d,"ts":%d,"ph":%q,"cat":%q,"name":%s,"args":%s}`,
 		t.pid,
 		e.tid,
 		ts.Nanoseconds()/1e3,
 		ph,
 		e.name,
-		e.v,
+		name,
+		args,
 	)
 }
 
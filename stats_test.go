@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestTraceEventJSON(t *testing.T) {
+	var f nopWriteCloser
+	var te traceEventT
+	te.start(&f)
+	target := "out/\x01é\U0001F600"
+	e := te.begin("run", literal("echo \x1b[1m"+target), traceEventWorker)
+	e.args = map[string]interface{}{"target": target, "exit": 1}
+	te.end(e)
+	te.stop()
+
+	var events []struct {
+		Ph   string                 `json:"ph"`
+		Name string                 `json:"name"`
+		Args map[string]interface{} `json:"args"`
+	}
+	err := json.Unmarshal(f.Bytes(), &events)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(%q)=%v", f.String(), err)
+	}
+	if len(events) != 2 || events[1].Ph != "E" {
+		t.Fatalf("events=%v; want B and E", events)
+	}
+	if got, want := events[0].Name, "echo \x1b[1m"+target; got != want {
+		t.Errorf("name=%q; want=%q", got, want)
+	}
+	if got := events[1].Args["target"]; got != target {
+		t.Errorf("args.target=%q; want=%q", got, target)
+	}
+	if got := events[1].Args["exit"]; got != 1.0 {
+		t.Errorf("args.exit=%v; want=1", got)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// defaultStatusFormat is the status format used when KATI_STATUS is
+// not set. The format is the same as NINJA_STATUS:
+//
+//	%s  the number of started jobs
+//	%t  the total number of jobs to run
+//	%r  the number of running jobs
+//	%u  the number of jobs not started yet
+//	%f  the number of finished jobs
+//	%p  the percentage of finished jobs
+//	%e  elapsed time in seconds
+//	%%  a plain '%'
+const defaultStatusFormat = "[%f/%t] "
+
+// buildStatus prints ninja-style status lines for jobs.
+type buildStatus struct {
+	mu        sync.Mutex
+	w         io.Writer
+	format    string
+	smart     bool
+	startTime time.Time
+
+	total    int
+	started  int
+	finished int
+}
+
+func newBuildStatus(w io.Writer) *buildStatus {
+	format := os.Getenv("KATI_STATUS")
+	if format == "" {
+		format = defaultStatusFormat
+	}
+	return &buildStatus{
+		w:         w,
+		format:    format,
+		smart:     isSmartTerminal(w),
+		startTime: time.Now(),
+	}
+}
+
+func isSmartTerminal(w io.Writer) bool {
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func terminalWidth(f *os.File) int {
+	var ws struct {
+		row, col, xpixel, ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.col == 0 {
+		return 80
+	}
+	return int(ws.col)
+}
+
+// addJob is called for each job which may run commands.
+func (s *buildStatus) addJob() {
+	s.mu.Lock()
+	s.total++
+	s.mu.Unlock()
+}
+
+// jobSkipped is called when a job added by addJob turns out to run
+// no commands.
+func (s *buildStatus) jobSkipped() {
+	s.mu.Lock()
+	s.total--
+	s.mu.Unlock()
+}
+
+func (s *buildStatus) jobStarted(target string) {
+	s.mu.Lock()
+	s.started++
+	line := s.formatStatus() + target
+	s.mu.Unlock()
+	s.print(line)
+}
+
+func (s *buildStatus) jobFinished(target string) {
+	s.mu.Lock()
+	s.finished++
+	line := s.formatStatus() + target
+	s.mu.Unlock()
+	// Only an updating line is worth reprinting.
+	if s.smart {
+		s.print(line)
+	}
+}
+
+// done terminates the status line on a smart terminal.
+func (s *buildStatus) done() {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if statusLineShown {
+		io.WriteString(s.w, "\n")
+		statusLineShown = false
+	}
+}
+
+func (s *buildStatus) formatStatus() string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s.format); i++ {
+		c := s.format[i]
+		if c != '%' || i+1 == len(s.format) {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		switch s.format[i] {
+		case 's':
+			fmt.Fprintf(&buf, "%d", s.started)
+		case 't':
+			fmt.Fprintf(&buf, "%d", s.total)
+		case 'r':
+			fmt.Fprintf(&buf, "%d", s.started-s.finished)
+		case 'u':
+			fmt.Fprintf(&buf, "%d", s.total-s.started)
+		case 'f':
+			fmt.Fprintf(&buf, "%d", s.finished)
+		case 'p':
+			p := 100
+			if s.total > 0 {
+				p = s.finished * 100 / s.total
+			}
+			fmt.Fprintf(&buf, "%3d%%", p)
+		case 'e':
+			fmt.Fprintf(&buf, "%.3f", time.Since(s.startTime).Seconds())
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(s.format[i])
+		}
+	}
+	return buf.String()
+}
+
+// truncateLine returns line cut to n runes at most.
+func truncateLine(line string, n int) string {
+	for i := range line {
+		if n == 0 {
+			return line[:i]
+		}
+		n--
+	}
+	return line
+}
+
+func (s *buildStatus) print(line string) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if !s.smart {
+		fmt.Fprintln(s.w, line)
+		return
+	}
+	// Keep the line in a single row, so \r can overwrite it.
+	line = truncateLine(line, terminalWidth(s.w.(*os.File))-1)
+	fmt.Fprintf(s.w, "\r%s\x1b[K", line)
+	statusLineShown = true
+	statusOut = s.w
+}
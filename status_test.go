@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatStatus(t *testing.T) {
+	s := &buildStatus{
+		startTime: time.Now(),
+		total:     8,
+		started:   5,
+		finished:  2,
+	}
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{format: defaultStatusFormat, want: "[2/8] "},
+		{format: "%s %t %r %u %f", want: "5 8 3 3 2"},
+		{format: "%p", want: " 25%"},
+		{format: "100%% %x", want: "100% %x"},
+		{format: "trailing %", want: "trailing %"},
+	} {
+		s.format = tc.format
+		if got := s.formatStatus(); got != tc.want {
+			t.Errorf("formatStatus(%q)=%q; want=%q", tc.format, got, tc.want)
+		}
+	}
+	s.format = "%e"
+	if got := s.formatStatus(); !strings.HasPrefix(got, "0.") {
+		t.Errorf("formatStatus(%q)=%q; want=0.*", s.format, got)
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		n    int
+		want string
+	}{
+		{line: "abc", n: 5, want: "abc"},
+		{line: "abc", n: 3, want: "abc"},
+		{line: "abcdef", n: 3, want: "abc"},
+		{line: "[1/2] 日本語.o", n: 8, want: "[1/2] 日本"},
+	} {
+		if got := truncateLine(tc.line, tc.n); got != tc.want {
+			t.Errorf("truncateLine(%q, %d)=%q; want=%q", tc.line, tc.n, got, tc.want)
+		}
+	}
+}
+
+// TestStatusCreateRunnersError checks a job whose commands can't be
+// expanded is not left in the total.
+func TestStatusCreateRunnersError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := loadTestMakefile(t, dir, `
+$(D)/bad:
+	$(error bad recipe)
+`)
+	var stdout bytes.Buffer
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, Stdout: &stdout, ShowStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ex.ExecContext(context.Background(), g)
+	if err == nil {
+		t.Errorf("ExecContext()=_, <nil>; want error")
+	}
+	if ex.status.total != ex.status.finished {
+		t.Errorf("total=%d finished=%d; want the same", ex.status.total, ex.status.finished)
+	}
+}
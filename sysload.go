@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// loadAverage returns the 1-minute load average in /proc/loadavg.
+func loadAverage() (float64, error) {
+	c, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	return parseLoadavg(c)
+}
+
+func parseLoadavg(c []byte) (float64, error) {
+	fields := bytes.Fields(c)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("broken loadavg: %q", c)
+	}
+	return strconv.ParseFloat(string(fields[0]), 64)
+}
+
+// usedMemory returns the bytes of memory in use, i.e. MemTotal minus
+// MemAvailable in /proc/meminfo.
+func usedMemory() (int64, error) {
+	c, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	return parseMeminfo(c)
+}
+
+func parseMeminfo(c []byte) (int64, error) {
+	total := int64(-1)
+	avail := int64(-1)
+	for _, line := range bytes.Split(c, []byte{'\n'}) {
+		// e.g. "MemTotal:       16318624 kB"
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		var p *int64
+		switch string(fields[0]) {
+		case "MemTotal:":
+			p = &total
+		case "MemAvailable:":
+			p = &avail
+		default:
+			continue
+		}
+		v, err := strconv.ParseInt(string(fields[1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("broken meminfo: %q: %v", line, err)
+		}
+		if len(fields) >= 3 && string(fields[2]) == "kB" {
+			v *= 1024
+		}
+		*p = v
+	}
+	if total < 0 || avail < 0 {
+		return 0, fmt.Errorf("no MemTotal or MemAvailable in meminfo")
+	}
+	return total - avail, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import "testing"
+
+func TestParseLoadavg(t *testing.T) {
+	got, err := parseLoadavg([]byte("12.34 10.01 8.00 3/1024 4242\n"))
+	if err != nil || got != 12.34 {
+		t.Errorf(`parseLoadavg(...)=%v, %v; want=12.34, <nil>`, got, err)
+	}
+	_, err = parseLoadavg([]byte(""))
+	if err == nil {
+		t.Errorf(`parseLoadavg("") unexpectedly has no error`)
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	got, err := parseMeminfo([]byte(`MemTotal:       16000000 kB
+MemFree:         1000000 kB
+MemAvailable:    6000000 kB
+Buffers:          300000 kB
+`))
+	if want := int64(10000000 * 1024); err != nil || got != want {
+		t.Errorf(`parseMeminfo(...)=%d, %v; want=%d, <nil>`, got, err, want)
+	}
+	_, err = parseMeminfo([]byte("MemTotal: 16000000 kB\n"))
+	if err == nil {
+		t.Errorf(`parseMeminfo(...) without MemAvailable unexpectedly has no error`)
+	}
+}
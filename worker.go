@@ -16,10 +16,12 @@ package kati
 
 import (
 	"container/heap"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -32,10 +34,28 @@ type job struct {
 	numDeps  int
 	depsTs   int64
 	id       int
+	priority int64
+	pool     *jobPool
+
+	// tid is the thread id for trace events, given by the worker.
+	tid   int
+	state jobState
+	exit  int
 
 	runners []runner
 }
 
+// jobState is how a job ended.
+type jobState int
+
+const (
+	jobNoRule jobState = iota
+	jobUpToDate
+	jobBuilt
+	jobCached
+	jobFailed
+)
+
 type jobResult struct {
 	j   *job
 	w   *worker
@@ -48,6 +68,7 @@ type newDep struct {
 }
 
 type worker struct {
+	id       int
 	wm       *workerManager
 	jobChan  chan *job
 	waitChan chan bool
@@ -60,7 +81,12 @@ func (jq jobQueue) Len() int      { return len(jq) }
 func (jq jobQueue) Swap(i, j int) { jq[i], jq[j] = jq[j], jq[i] }
 
 func (jq jobQueue) Less(i, j int) bool {
-	// First come, first serve, for GNU make compatibility.
+	// Jobs on a longer critical path go first. Without critical
+	// path scheduling all priorities are zero, and this is first
+	// come, first serve, for GNU make compatibility.
+	if jq[i].priority != jq[j].priority {
+		return jq[i].priority > jq[j].priority
+	}
 	return jq[i].id < jq[j].id
 }
 
@@ -77,8 +103,9 @@ func (jq *jobQueue) Pop() interface{} {
 	return item
 }
 
-func newWorker(wm *workerManager) *worker {
+func newWorker(wm *workerManager, id int) *worker {
 	w := &worker{
+		id:       id,
 		wm:       wm,
 		jobChan:  make(chan *job),
 		waitChan: make(chan bool),
@@ -92,7 +119,19 @@ func (w *worker) Run() {
 	for !done {
 		select {
 		case j := <-w.jobChan:
+			j.tid = traceEventWorker + w.id
+			startTime := time.Now()
 			err := j.build()
+			d := time.Since(startTime)
+			j.ex.metrics.add(j, startTime, d)
+			if o := j.ex.observer; o != nil && j.n.HasRule {
+				switch j.state {
+				case jobUpToDate:
+					o.JobSkipped(j.n.Output)
+				case jobBuilt, jobCached, jobFailed:
+					o.JobFinished(j.n.Output, d, j.exit)
+				}
+			}
 			w.wm.ReportResult(w, j, err)
 		case done = <-w.waitChan:
 		}
@@ -111,7 +150,15 @@ func (w *worker) Wait() {
 
 func (j *job) createRunners() ([]runner, error) {
 	runners, _, err := createRunners(j.ex.ctx, j.n)
-	return runners, err
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range runners {
+		if cmd, ok := j.ex.ccWrapper.wrap(trimLeftSpace(r.cmd)); ok {
+			runners[i].cmd = cmd
+		}
+	}
+	return runners, nil
 }
 
 // TODO(ukai): use time.Time?
@@ -140,23 +187,153 @@ func (j *job) build() error {
 		return fmt.Errorf("*** No rule to make target %q, needed by %q.", j.n.Output, j.parents[0].n.Output)
 	}
 
+	status := j.ex.status
+	hs := j.ex.hashState
+	if hs != nil && j.n.IsPhony {
+		hs = nil
+	}
 	if j.outputTs >= j.depsTs {
 		// TODO: stats.
+		j.state = jobUpToDate
+		if status != nil && len(j.n.Cmds) > 0 {
+			status.jobSkipped()
+		}
+		if hs != nil {
+			hs.record(j.n)
+		}
 		return nil
 	}
+	if hs != nil && j.outputTs >= 0 && hs.upToDate(j.n) {
+		logf("%s: inputs have the same contents", j.n.Output)
+		j.state = jobUpToDate
+		if status != nil && len(j.n.Cmds) > 0 {
+			status.jobSkipped()
+		}
+		return nil
+	}
+	prevTs := j.outputTs
 
 	rr, err := j.createRunners()
 	if err != nil {
+		j.state = jobFailed
+		if status != nil && len(j.n.Cmds) > 0 {
+			status.jobSkipped()
+		}
+		// Observers see the failed job as started, as JobFinished
+		// follows.
+		if o := j.ex.observer; o != nil {
+			o.JobStarted(j.n.Output)
+		}
 		return err
 	}
+	if status != nil && len(j.n.Cmds) > 0 {
+		if len(rr) == 0 {
+			status.jobSkipped()
+		} else {
+			status.jobStarted(j.n.Output)
+			defer status.jobFinished(j.n.Output)
+		}
+	}
+	out := newJobOutput(j.ex.outputSync, j.ex.stdout, j.ex.stderr)
+	defer out.flush()
+	if o := j.ex.observer; o != nil && len(rr) > 0 {
+		o.JobStarted(j.n.Output)
+		out.observe(o, j.n.Output)
+	}
+	if len(rr) > 0 {
+		te := traceEvent.begin("build", literal(j.n.Output), j.tid)
+		defer func() {
+			te.args = map[string]interface{}{"exit": j.exit}
+			traceEvent.end(te)
+		}()
+	}
+	var cacheKey string
+	if ac := j.ex.actionCache; ac != nil && j.n.IsCacheable && !j.n.IsPhony && len(rr) > 0 {
+		cacheKey, err = actionKey(j.n, rr, j.ex.actionEnv)
+		if err != nil {
+			logf("action cache: %s: %v", j.n.Output, err)
+		}
+		if cacheKey != "" {
+			hit, err := ac.get(cacheKey, j.n.Output)
+			if err != nil {
+				logf("action cache: %s: %v", j.n.Output, err)
+			}
+			if hit {
+				logf("action cache: %s restored", j.n.Output)
+				j.state = jobCached
+				j.finishBuild(len(rr) > 0, prevTs)
+				return nil
+			}
+		}
+	}
+	runCtx := j.ex.buildCtx
+	timeout, err := j.recipeTimeout()
+	if err != nil {
+		j.state = jobFailed
+		return err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(runCtx, timeout)
+		defer cancel()
+	}
+	if j.ex.stallWarning > 0 && len(rr) > 0 {
+		sw := newStallWatcher(j.n.Output, j.ex.stallWarning, j.ex.stderr)
+		defer sw.stop()
+		out.watch(sw)
+	}
+	startTime := time.Now()
 	for _, r := range rr {
-		err := r.run(j.n.Output)
+		rte := traceEvent.begin("run", literal(r.cmd), j.tid)
+		err := r.run(runCtx, j.n.Output, out.stdout, out.stderr)
+		exit := exitStatus(err)
+		rte.args = map[string]interface{}{"target": j.n.Output, "exit": exit}
+		traceEvent.end(rte)
 		if err != nil {
-			exit := exitStatus(err)
+			j.state = jobFailed
+			j.exit = exit
+			if runCtx.Err() == context.DeadlineExceeded && j.ex.buildCtx.Err() == nil {
+				return fmt.Errorf("[%s] timed out after %g s", j.n.Output, timeout.Seconds())
+			}
 			return fmt.Errorf("[%s] Error %d: %v", j.n.Output, exit, err)
 		}
 	}
+	if len(rr) > 0 {
+		j.state = jobBuilt
+	}
+	if j.ex.timings != nil && len(rr) > 0 {
+		j.ex.timings.record(j.n.Output, time.Since(startTime))
+	}
+	if cacheKey != "" {
+		err := j.ex.actionCache.put(cacheKey, j.n.Output)
+		if err != nil {
+			logf("action cache: %s: %v", j.n.Output, err)
+		}
+	}
+	j.finishBuild(len(rr) > 0, prevTs)
+	return nil
+}
+
+// recipeTimeout returns the timeout of the recipe, which is given by
+// .KATI_TIMEOUT in seconds or ExecutorOpt.RecipeTimeout.
+func (j *job) recipeTimeout() (time.Duration, error) {
+	v, ok, err := evalTargetSpecificVar(j.ex.ctx, j.n, ".KATI_TIMEOUT")
+	if err != nil {
+		return 0, err
+	}
+	if !ok || v == "" {
+		return j.ex.recipeTimeout, nil
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || sec < 0 {
+		return 0, fmt.Errorf("[%s] invalid .KATI_TIMEOUT: %q", j.n.Output, v)
+	}
+	return time.Duration(sec * float64(time.Second)), nil
+}
 
+// finishBuild updates the timestamp of the output, which was prevTs
+// before the build.
+func (j *job) finishBuild(ran bool, prevTs int64) {
 	if j.n.IsPhony {
 		j.outputTs = time.Now().Unix()
 	} else {
@@ -165,7 +342,12 @@ func (j *job) build() error {
 			j.outputTs = time.Now().Unix()
 		}
 	}
-	return nil
+	// Like ninja's restat, an output with the same contents does not
+	// make its parents stale.
+	if hs := j.ex.hashState; hs != nil && !j.n.IsPhony && ran && hs.rebuilt(j.n) && prevTs >= 0 {
+		logf("%s: output has the same contents", j.n.Output)
+		j.outputTs = prevTs
+	}
 }
 
 func (wm *workerManager) handleJobs() error {
@@ -176,7 +358,19 @@ func (wm *workerManager) handleJobs() error {
 		if wm.readyQueue.Len() == 0 {
 			return nil
 		}
+		// Like GNU make, we always allow at least one job to run.
+		if len(wm.busyWorkers) > 0 && wm.overloaded() {
+			return nil
+		}
 		j := heap.Pop(&wm.readyQueue).(*job)
+		if p := j.pool; p != nil {
+			if p.running >= p.depth {
+				logf("pool full: %s", j.n.Output)
+				p.delayed = append(p.delayed, j)
+				continue
+			}
+			p.running++
+		}
 		logf("run: %s", j.n.Output)
 
 		j.numDeps = -1 // Do not let other workers pick this.
@@ -187,6 +381,42 @@ func (wm *workerManager) handleJobs() error {
 	}
 }
 
+// releasePool makes a slot of j's pool available to a delayed job.
+func (wm *workerManager) releasePool(j *job) {
+	p := j.pool
+	if p == nil {
+		return
+	}
+	p.running--
+	if len(p.delayed) > 0 {
+		heap.Push(&wm.readyQueue, p.delayed[0])
+		p.delayed = p.delayed[1:]
+	}
+}
+
+// overloaded reports whether the machine is too busy to start a new job.
+func (wm *workerManager) overloaded() bool {
+	if wm.maxLoad > 0 {
+		load, err := loadAverage()
+		if err != nil {
+			logf("load average: %v", err)
+		} else if load >= wm.maxLoad {
+			logf("load average %.2f >= %.2f", load, wm.maxLoad)
+			return true
+		}
+	}
+	if wm.maxMem > 0 {
+		used, err := usedMemory()
+		if err != nil {
+			logf("used memory: %v", err)
+		} else if used >= wm.maxMem {
+			logf("used memory %d >= %d", used, wm.maxMem)
+			return true
+		}
+	}
+	return false
+}
+
 func (wm *workerManager) updateParents(j *job) {
 	for _, p := range j.parents {
 		p.numDeps--
@@ -200,12 +430,15 @@ func (wm *workerManager) updateParents(j *job) {
 
 type workerManager struct {
 	maxJobs     int
+	maxLoad     float64
+	maxMem      int64
 	jobs        []*job
 	readyQueue  jobQueue
 	jobChan     chan *job
 	resultChan  chan jobResult
 	newDepChan  chan newDep
 	stopChan    chan bool
+	cancelChan  chan error
 	waitChan    chan bool
 	doneChan    chan error
 	freeWorkers []*worker
@@ -216,13 +449,17 @@ type workerManager struct {
 	finishCnt int
 }
 
-func newWorkerManager(numJobs int) (*workerManager, error) {
+func newWorkerManager(opt *ExecutorOpt) (*workerManager, error) {
+	numJobs := opt.NumJobs
 	wm := &workerManager{
 		maxJobs:     numJobs,
+		maxLoad:     opt.MaxLoad,
+		maxMem:      opt.MaxMem,
 		jobChan:     make(chan *job),
 		resultChan:  make(chan jobResult),
 		newDepChan:  make(chan newDep),
 		stopChan:    make(chan bool),
+		cancelChan:  make(chan error, 1),
 		waitChan:    make(chan bool),
 		doneChan:    make(chan error),
 		busyWorkers: make(map[*worker]bool),
@@ -230,7 +467,7 @@ func newWorkerManager(numJobs int) (*workerManager, error) {
 
 	wm.busyWorkers = make(map[*worker]bool)
 	for i := 0; i < numJobs; i++ {
-		w := newWorker(wm)
+		w := newWorker(wm, i)
 		wm.freeWorkers = append(wm.freeWorkers, w)
 		go w.Run()
 	}
@@ -278,6 +515,14 @@ func (wm *workerManager) handleNewDep(j *job, neededBy *job) {
 func (wm *workerManager) Run() {
 	done := false
 	var err error
+	// While we are throttled by the load, nothing may happen until
+	// a running job finishes, so check the load periodically.
+	var tick <-chan time.Time
+	if wm.maxLoad > 0 || wm.maxMem > 0 {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 Loop:
 	for wm.hasTodo() || len(wm.busyWorkers) > 0 || len(wm.runnings) > 0 || !done {
 		select {
@@ -291,6 +536,7 @@ Loop:
 			delete(wm.busyWorkers, jr.w)
 			wm.freeWorkers = append(wm.freeWorkers, jr.w)
 			wm.updateParents(jr.j)
+			wm.releasePool(jr.j)
 			wm.finishCnt++
 			if jr.err != nil {
 				err = jr.err
@@ -301,6 +547,10 @@ Loop:
 			wm.handleNewDep(af.j, af.neededBy)
 			logf("dep: %s (%d) %s", af.neededBy.n.Output, af.neededBy.numDeps, af.j.n.Output)
 		case done = <-wm.waitChan:
+		case err = <-wm.cancelChan:
+			close(wm.stopChan)
+			break Loop
+		case <-tick:
 		}
 		err = wm.handleJobs()
 		if err != nil {
@@ -345,6 +595,14 @@ func (wm *workerManager) ReportNewDep(j *job, neededBy *job) {
 	}
 }
 
+// Cancel stops starting new jobs, and makes Wait return err.
+func (wm *workerManager) Cancel(err error) {
+	select {
+	case wm.cancelChan <- err:
+	default:
+	}
+}
+
 func (wm *workerManager) Wait() error {
 	wm.waitChan <- true
 	return <-wm.doneChan